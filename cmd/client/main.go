@@ -8,17 +8,47 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"time"
 
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"github.com/mchmarny/grpc-lab/pkg/cert"
 	"github.com/mchmarny/grpc-lab/pkg/client"
+	"github.com/mchmarny/grpc-lab/pkg/tracing"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
-	address   = flag.String("address", ":50505", "Server address (:50505)")
+	address   = flag.String("address", ":50505", "Server address (:50505), comma separated addresses, or a gRPC target, e.g. dns:///ping.example.com:50505")
+	balancer  = flag.String("balancer", "", "Load balancing across the server addresses: round_robin or pick_first (default)")
 	clientID  = flag.String("client", "demo", "ID of this client")
 	streamNum = flag.Int64("stream", 0, "number of messages to stream")
+	processor = flag.String("processor", "", "Processor pipeline applied to messages, e.g. reverse|upper (server default)")
 	debug     = flag.Bool("debug", false, "Verbose logging")
+
+	timeout           = flag.Duration("timeout", client.DefaultTimeout, "Deadline of each ping (0 disables)")
+	streamTimeout     = flag.Duration("stream-timeout", 0, "Deadline of the entire stream (0 disables)")
+	streamIdleTimeout = flag.Duration("stream-idle-timeout", client.DefaultStreamIdleTimeout, "Max time a stream can go without sending or receiving a message (0 disables)")
+
+	retries         = flag.Int("retries", 0, "Max attempts of each call including the first, up to 5 (0 disables retries)")
+	retryBackoff    = flag.Duration("retry-backoff", client.DefaultRetryPolicy.InitialBackoff, "Backoff before the first retry")
+	retryMaxBackoff = flag.Duration("retry-max-backoff", client.DefaultRetryPolicy.MaxBackoff, "Max backoff between retries")
+	retryCodes      = flag.String("retry-codes", "UNAVAILABLE", "Comma separated codes of the calls which are retried")
+	hedge           = flag.Bool("hedge", false, "Hedge pings by sending the next attempt without waiting for the previous one to fail, up to --retries attempts (requires --retries)")
+	hedgeDelay      = flag.Duration("hedge-delay", 100*time.Millisecond, "Time after which the next hedged attempt is sent")
+
+	benchDuration    = flag.Duration("bench", 0, "Benchmarks the server for the duration instead of prompting (e.g. 30s)")
+	benchMethod      = flag.String("bench-method", client.BenchPing, "Benchmarked method: ping or stream")
+	benchQPS         = flag.Int("bench-qps", 0, "Target messages per second across all workers (0 sends as fast as possible)")
+	benchConcurrency = flag.Int("bench-concurrency", 1, "Number of concurrent workers (one stream each)")
+	benchPayload     = flag.Int("bench-payload", client.DefaultBenchPayloadSize, "Size of the message data in bytes")
+	benchOutput      = flag.String("bench-output", "text", "Bench report format: text or json")
+
+	useTLS     = flag.Bool("tls", false, "Connect using TLS (implied by --ca, --cert, and --key)")
+	caFile     = flag.String("ca", "", "CA bundle used to verify the server (defaults to host roots)")
+	certFile   = flag.String("cert", "", "Client certificate presented to the server (mTLS)")
+	keyFile    = flag.String("key", "", "Client certificate key (mTLS)")
+	serverName = flag.String("server-name", "", "Overrides the server name used to verify its certificate")
 )
 
 func prompt(ctx context.Context, c *client.PingClient) error {
@@ -66,12 +96,71 @@ func stream(ctx context.Context, c *client.PingClient, n int64) error {
 		list = append(list, fmt.Sprintf("test %d", i))
 	}
 
-	if err := c.StreamList(ctx, list); err != nil {
+	var rtt time.Duration
+	summary, err := c.StreamEach(ctx, list, func(r *client.StreamResult) {
+		id := r.Request.GetContent().GetId()
+		switch {
+		case r.Missing:
+			fmt.Printf("%s - missing response\n", id)
+		case r.Response.GetResult() == pb.PingResponse_Error:
+			fmt.Printf("%s - error: %s\n", id, r.Response.GetErrorMessage())
+		default:
+			rtt += r.RTT
+			log.Debugf("%s - %s (rtt: %v, out of order: %v)", id, r.Response.GetDetail(), r.RTT, r.OutOfOrder)
+		}
+	})
+	if err != nil {
 		return errors.Wrap(err, "error streaming")
 	}
+
+	succeeded := summary.Received - summary.Failed
+	fmt.Printf("streamed %d messages, %d succeeded, %d failed, %d missing, %d out of order\n",
+		summary.Sent, succeeded, summary.Failed, summary.Missing, summary.OutOfOrder)
+	if succeeded > 0 {
+		fmt.Printf("mean round trip: %v\n", rtt/time.Duration(succeeded))
+	}
 	return nil
 }
 
+func bench(ctx context.Context, c *client.PingClient) error {
+	if c == nil {
+		return errors.New("client required")
+	}
+	if *benchOutput != "text" && *benchOutput != "json" {
+		return errors.Errorf("invalid bench output: %s", *benchOutput)
+	}
+
+	report, err := c.Bench(ctx, client.BenchConfig{
+		Method:      *benchMethod,
+		Duration:    *benchDuration,
+		QPS:         *benchQPS,
+		Concurrency: *benchConcurrency,
+		PayloadSize: *benchPayload,
+	})
+	if err != nil {
+		return errors.Wrap(err, "error benchmarking")
+	}
+	if *benchOutput == "json" {
+		return report.WriteJSON(os.Stdout)
+	}
+	return report.WriteText(os.Stdout)
+}
+
+func retryPolicy() (client.RetryPolicy, error) {
+	list, err := client.ParseCodes(*retryCodes)
+	if err != nil {
+		return client.RetryPolicy{}, err
+	}
+	policy := client.DefaultRetryPolicy
+	policy.MaxAttempts = *retries
+	policy.InitialBackoff = *retryBackoff
+	policy.MaxBackoff = *retryMaxBackoff
+	policy.RetryableCodes = list
+	policy.Hedging = *hedge
+	policy.HedgingDelay = *hedgeDelay
+	return policy, nil
+}
+
 func main() {
 	flag.Parse()
 	log.SetFormatter(&log.JSONFormatter{})
@@ -81,6 +170,16 @@ func main() {
 		log.SetLevel(log.TraceLevel)
 	}
 
+	shutdownTracing, err := tracing.Init(context.Background(), "ping-client")
+	if err != nil {
+		log.Fatalf("error initializing tracing: %v", err)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.Errorf("error flushing traces: %v", err)
+		}
+	}()
+
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, os.Interrupt)
 	ctx, cancel := context.WithCancel(context.Background())
@@ -91,16 +190,50 @@ func main() {
 		os.Exit(0)
 	}()
 
-	c, err := client.NewPingClient(ctx, *address, *clientID)
+	opts := []client.Option{
+		client.WithTimeout(*timeout),
+		client.WithStreamTimeout(*streamTimeout),
+		client.WithStreamIdleTimeout(*streamIdleTimeout),
+	}
+	if *useTLS || *caFile != "" || *certFile != "" || *keyFile != "" {
+		cfg, err := cert.NewClientConfig(*caFile, *certFile, *keyFile, *serverName)
+		if err != nil {
+			log.Fatalf("error creating TLS config: %v", err)
+		}
+		opts = append(opts, client.WithTLS(cfg))
+	}
+	if *balancer != "" {
+		opts = append(opts, client.WithBalancer(*balancer))
+	}
+	if *processor != "" {
+		opts = append(opts, client.WithProcessor(*processor))
+	}
+	if *hedge && *retries == 0 {
+		log.Fatal("--hedge requires --retries to set the max number of hedged attempts")
+	}
+	if *retries > 0 {
+		policy, err := retryPolicy()
+		if err != nil {
+			log.Fatalf("error creating retry policy: %v", err)
+		}
+		opts = append(opts, client.WithRetryPolicy(policy))
+	}
+
+	c, err := client.NewPingClient(ctx, *address, *clientID, opts...)
 	if err != nil {
 		log.Fatalf("error creating client: %v", err)
 	}
 
-	if streamNum != nil && *streamNum > 0 {
+	switch {
+	case *benchDuration > 0:
+		if err := bench(ctx, c); err != nil {
+			log.Fatalf("error executing bench: %v", err)
+		}
+	case *streamNum > 0:
 		if err := stream(ctx, c, *streamNum); err != nil {
 			log.Fatalf("error executing stream: %v", err)
 		}
-	} else {
+	default:
 		if err := prompt(ctx, c); err != nil {
 			log.Fatalf("error executing prompt: %v", err)
 		}
@@ -7,18 +7,46 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 
+	"github.com/mchmarny/grpc-lab/pkg/cert"
 	"github.com/mchmarny/grpc-lab/pkg/config"
 	"github.com/mchmarny/grpc-lab/pkg/service"
+	"github.com/mchmarny/grpc-lab/pkg/store"
+	"github.com/mchmarny/grpc-lab/pkg/tracing"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 )
 
+// version is set at build time, e.g. -ldflags=-X=main.version=v0.2.3
+var version = "dev"
+
 var (
 	address  = config.GetEnvVar("ADDRESS", "0.0.0.0")
 	grpcPort = config.GetEnvVar("GRPC_PORT", "50505")
 	httpPort = config.GetEnvVar("HTTP_PORT", "")
 	debug    = config.GetEnvBoolVar("DEBUG", false)
+	certFile = config.GetEnvVar("TLS_CERT", "")
+	keyFile  = config.GetEnvVar("TLS_KEY", "")
+	caFile   = config.GetEnvVar("TLS_CA", "")
+	reload   = config.GetEnvDurationVar("TLS_RELOAD_INTERVAL", cert.DefaultReloadInterval)
+	drain    = config.GetEnvDurationVar("DRAIN_TIMEOUT", service.DefaultDrainTimeout)
+	dedup    = config.GetEnvDurationVar("DEDUP_WINDOW", service.DefaultDedupWindow)
+	dedupMax = config.GetEnvIntVar("DEDUP_MAX_ENTRIES", service.DefaultDedupMaxEntries)
+
+	storeType   = config.GetEnvVar("STORE_TYPE", store.MemoryType)
+	storePath   = config.GetEnvVar("STORE_PATH", "ping.db")
+	historySize = config.GetEnvIntVar("STORE_HISTORY_SIZE", store.DefaultHistorySize)
+
+	subBuffer = config.GetEnvIntVar("SUBSCRIBER_BUFFER", service.DefaultSubscriberBuffer)
+	subPolicy = config.GetEnvVar("SUBSCRIBER_POLICY", string(service.DropPolicy))
+
+	faultInjection  = config.GetEnvBoolVar("FAULT_INJECTION_ENABLED", false)
+	faultDelay      = config.GetEnvDurationVar("FAULT_DELAY", 0)
+	faultCode       = config.GetEnvVar("FAULT_CODE", "")
+	faultPercent    = config.GetEnvIntVar("FAULT_PERCENT", 0)
+	faultAbortAfter = config.GetEnvIntVar("FAULT_ABORT_AFTER", 0)
+	faultHang       = config.GetEnvBoolVar("FAULT_HANG", false)
 )
 
 func main() {
@@ -30,6 +58,26 @@ func main() {
 		log.SetLevel(log.TraceLevel)
 	}
 
+	shutdownTracing, err := tracing.Init(context.Background(), "ping-server")
+	if err != nil {
+		log.Fatalf("error initializing tracing: %v", err)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.Errorf("error flushing traces: %v", err)
+		}
+	}()
+
+	st, err := store.New(storeType, storePath, historySize)
+	if err != nil {
+		log.Fatalf("error creating %s store: %v", storeType, err)
+	}
+	defer func() {
+		if err := st.Close(); err != nil {
+			log.Errorf("error closing store: %v", err)
+		}
+	}()
+
 	addr := net.JoinHostPort(address, grpcPort)
 	lis, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -37,41 +85,80 @@ func main() {
 	}
 	defer lis.Close()
 
-	srv := service.NewPingService(lis)
+	faults := service.Faults{
+		Delay:      faultDelay,
+		Percent:    faultPercent,
+		AbortAfter: faultAbortAfter,
+		Hang:       faultHang,
+	}
+	if faultCode != "" {
+		if faults.Code, err = service.ParseCode(faultCode); err != nil {
+			log.Fatalf("error parsing FAULT_CODE: %v", err)
+		}
+	}
+
+	opts := []service.Option{
+		service.WithDrainTimeout(drain),
+		service.WithStore(st),
+		service.WithDedupWindow(dedup),
+		service.WithDedupMaxEntries(dedupMax),
+		service.WithSubscriberBuffer(subBuffer, service.SlowConsumerPolicy(subPolicy)),
+		service.WithFaultInjection(faultInjection),
+		service.WithFaults(faults),
+		service.WithVersion(version),
+	}
+	if certFile != "" || keyFile != "" {
+		opts = append(opts,
+			service.WithTLS(certFile, keyFile, caFile),
+			service.WithCertReloadInterval(reload),
+		)
+	}
+
+	srv := service.NewPingService(lis, opts...)
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
 	ctx, cancel := context.WithCancel(context.Background())
-	exitCh := make(chan error, 1)
+	defer cancel()
+	exitCh := make(chan error, 2)
+	servers := 1
 
 	go func() {
 		if err := srv.Start(ctx); err != nil && err != grpc.ErrServerStopped {
 			log.Error("grpc server error")
 			exitCh <- err
+			return
 		}
 		exitCh <- nil
 	}()
 
 	if httpPort != "" {
+		servers++
 		go func() {
 			addr := net.JoinHostPort(address, httpPort)
 			if err := srv.StartHTTP(ctx, addr); err != nil && err != http.ErrServerClosed {
 				log.Error("http server error")
 				exitCh <- err
+				return
 			}
 			exitCh <- nil
 		}()
 	}
 
-	for {
-		select {
-		case <-sigCh:
-			cancel()
-			return
-		case err := <-exitCh:
-			if err != nil {
-				log.Error(err)
-			}
-			return
+	// wait for a signal or either server to exit, then drain the rest
+	select {
+	case sig := <-sigCh:
+		log.Infof("received %v signal, shutting down", sig)
+	case err := <-exitCh:
+		servers--
+		if err != nil {
+			log.Error(err)
+		}
+	}
+
+	cancel()
+	for ; servers > 0; servers-- {
+		if err := <-exitCh; err != nil {
+			log.Error(err)
 		}
 	}
 }
@@ -22,6 +22,21 @@ type ServiceClient interface {
 	Ping(ctx context.Context, in *PingRequest, opts ...grpc.CallOption) (*PingResponse, error)
 	// Stream is like Ping but with stream
 	Stream(ctx context.Context, opts ...grpc.CallOption) (Service_StreamClient, error)
+	// GetStats returns the message counters of each client
+	GetStats(ctx context.Context, in *GetStatsRequest, opts ...grpc.CallOption) (*GetStatsResponse, error)
+	// ListMessages returns the recently processed messages, newest first
+	ListMessages(ctx context.Context, in *ListMessagesRequest, opts ...grpc.CallOption) (*ListMessagesResponse, error)
+	// GetMessage returns the most recently processed message with the content ID
+	GetMessage(ctx context.Context, in *GetMessageRequest, opts ...grpc.CallOption) (*Message, error)
+	// Subscribe streams the responses of the messages as they are processed
+	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Service_SubscribeClient, error)
+	// GetFaults returns the faults injected into all the calls
+	GetFaults(ctx context.Context, in *GetFaultsRequest, opts ...grpc.CallOption) (*Faults, error)
+	// SetFaults replaces the faults injected into all the calls. It's denied
+	// unless fault injection is enabled, and it's not exposed on the HTTP gateway.
+	SetFaults(ctx context.Context, in *Faults, opts ...grpc.CallOption) (*Faults, error)
+	// GetInfo returns the identity of the server instance
+	GetInfo(ctx context.Context, in *GetInfoRequest, opts ...grpc.CallOption) (*ServerInfo, error)
 }
 
 type serviceClient struct {
@@ -72,6 +87,92 @@ func (x *serviceStreamClient) Recv() (*PingResponse, error) {
 	return m, nil
 }
 
+func (c *serviceClient) GetStats(ctx context.Context, in *GetStatsRequest, opts ...grpc.CallOption) (*GetStatsResponse, error) {
+	out := new(GetStatsResponse)
+	err := c.cc.Invoke(ctx, "/io.thingz.grpc.v1.Service/GetStats", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *serviceClient) ListMessages(ctx context.Context, in *ListMessagesRequest, opts ...grpc.CallOption) (*ListMessagesResponse, error) {
+	out := new(ListMessagesResponse)
+	err := c.cc.Invoke(ctx, "/io.thingz.grpc.v1.Service/ListMessages", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *serviceClient) GetMessage(ctx context.Context, in *GetMessageRequest, opts ...grpc.CallOption) (*Message, error) {
+	out := new(Message)
+	err := c.cc.Invoke(ctx, "/io.thingz.grpc.v1.Service/GetMessage", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *serviceClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Service_SubscribeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Service_ServiceDesc.Streams[1], "/io.thingz.grpc.v1.Service/Subscribe", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &serviceSubscribeClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Service_SubscribeClient interface {
+	Recv() (*PingResponse, error)
+	grpc.ClientStream
+}
+
+type serviceSubscribeClient struct {
+	grpc.ClientStream
+}
+
+func (x *serviceSubscribeClient) Recv() (*PingResponse, error) {
+	m := new(PingResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *serviceClient) GetFaults(ctx context.Context, in *GetFaultsRequest, opts ...grpc.CallOption) (*Faults, error) {
+	out := new(Faults)
+	err := c.cc.Invoke(ctx, "/io.thingz.grpc.v1.Service/GetFaults", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *serviceClient) SetFaults(ctx context.Context, in *Faults, opts ...grpc.CallOption) (*Faults, error) {
+	out := new(Faults)
+	err := c.cc.Invoke(ctx, "/io.thingz.grpc.v1.Service/SetFaults", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *serviceClient) GetInfo(ctx context.Context, in *GetInfoRequest, opts ...grpc.CallOption) (*ServerInfo, error) {
+	out := new(ServerInfo)
+	err := c.cc.Invoke(ctx, "/io.thingz.grpc.v1.Service/GetInfo", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // ServiceServer is the server API for Service service.
 // All implementations must embed UnimplementedServiceServer
 // for forward compatibility
@@ -80,6 +181,21 @@ type ServiceServer interface {
 	Ping(context.Context, *PingRequest) (*PingResponse, error)
 	// Stream is like Ping but with stream
 	Stream(Service_StreamServer) error
+	// GetStats returns the message counters of each client
+	GetStats(context.Context, *GetStatsRequest) (*GetStatsResponse, error)
+	// ListMessages returns the recently processed messages, newest first
+	ListMessages(context.Context, *ListMessagesRequest) (*ListMessagesResponse, error)
+	// GetMessage returns the most recently processed message with the content ID
+	GetMessage(context.Context, *GetMessageRequest) (*Message, error)
+	// Subscribe streams the responses of the messages as they are processed
+	Subscribe(*SubscribeRequest, Service_SubscribeServer) error
+	// GetFaults returns the faults injected into all the calls
+	GetFaults(context.Context, *GetFaultsRequest) (*Faults, error)
+	// SetFaults replaces the faults injected into all the calls. It's denied
+	// unless fault injection is enabled, and it's not exposed on the HTTP gateway.
+	SetFaults(context.Context, *Faults) (*Faults, error)
+	// GetInfo returns the identity of the server instance
+	GetInfo(context.Context, *GetInfoRequest) (*ServerInfo, error)
 	mustEmbedUnimplementedServiceServer()
 }
 
@@ -93,6 +209,27 @@ func (UnimplementedServiceServer) Ping(context.Context, *PingRequest) (*PingResp
 func (UnimplementedServiceServer) Stream(Service_StreamServer) error {
 	return status.Errorf(codes.Unimplemented, "method Stream not implemented")
 }
+func (UnimplementedServiceServer) GetStats(context.Context, *GetStatsRequest) (*GetStatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStats not implemented")
+}
+func (UnimplementedServiceServer) ListMessages(context.Context, *ListMessagesRequest) (*ListMessagesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListMessages not implemented")
+}
+func (UnimplementedServiceServer) GetMessage(context.Context, *GetMessageRequest) (*Message, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetMessage not implemented")
+}
+func (UnimplementedServiceServer) Subscribe(*SubscribeRequest, Service_SubscribeServer) error {
+	return status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
+}
+func (UnimplementedServiceServer) GetFaults(context.Context, *GetFaultsRequest) (*Faults, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetFaults not implemented")
+}
+func (UnimplementedServiceServer) SetFaults(context.Context, *Faults) (*Faults, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetFaults not implemented")
+}
+func (UnimplementedServiceServer) GetInfo(context.Context, *GetInfoRequest) (*ServerInfo, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetInfo not implemented")
+}
 func (UnimplementedServiceServer) mustEmbedUnimplementedServiceServer() {}
 
 // UnsafeServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -150,6 +287,135 @@ func (x *serviceStreamServer) Recv() (*PingRequest, error) {
 	return m, nil
 }
 
+func _Service_GetStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ServiceServer).GetStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/io.thingz.grpc.v1.Service/GetStats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ServiceServer).GetStats(ctx, req.(*GetStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Service_ListMessages_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListMessagesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ServiceServer).ListMessages(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/io.thingz.grpc.v1.Service/ListMessages",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ServiceServer).ListMessages(ctx, req.(*ListMessagesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Service_GetMessage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetMessageRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ServiceServer).GetMessage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/io.thingz.grpc.v1.Service/GetMessage",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ServiceServer).GetMessage(ctx, req.(*GetMessageRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Service_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ServiceServer).Subscribe(m, &serviceSubscribeServer{stream})
+}
+
+type Service_SubscribeServer interface {
+	Send(*PingResponse) error
+	grpc.ServerStream
+}
+
+type serviceSubscribeServer struct {
+	grpc.ServerStream
+}
+
+func (x *serviceSubscribeServer) Send(m *PingResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Service_GetFaults_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetFaultsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ServiceServer).GetFaults(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/io.thingz.grpc.v1.Service/GetFaults",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ServiceServer).GetFaults(ctx, req.(*GetFaultsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Service_SetFaults_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Faults)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ServiceServer).SetFaults(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/io.thingz.grpc.v1.Service/SetFaults",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ServiceServer).SetFaults(ctx, req.(*Faults))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Service_GetInfo_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetInfoRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ServiceServer).GetInfo(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/io.thingz.grpc.v1.Service/GetInfo",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ServiceServer).GetInfo(ctx, req.(*GetInfoRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Service_ServiceDesc is the grpc.ServiceDesc for Service service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -161,6 +427,30 @@ var Service_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Ping",
 			Handler:    _Service_Ping_Handler,
 		},
+		{
+			MethodName: "GetStats",
+			Handler:    _Service_GetStats_Handler,
+		},
+		{
+			MethodName: "ListMessages",
+			Handler:    _Service_ListMessages_Handler,
+		},
+		{
+			MethodName: "GetMessage",
+			Handler:    _Service_GetMessage_Handler,
+		},
+		{
+			MethodName: "GetFaults",
+			Handler:    _Service_GetFaults_Handler,
+		},
+		{
+			MethodName: "SetFaults",
+			Handler:    _Service_SetFaults_Handler,
+		},
+		{
+			MethodName: "GetInfo",
+			Handler:    _Service_GetInfo_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -169,6 +459,11 @@ var Service_ServiceDesc = grpc.ServiceDesc{
 			ServerStreams: true,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "Subscribe",
+			Handler:       _Service_Subscribe_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "v1/ping.proto",
 }
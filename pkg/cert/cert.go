@@ -0,0 +1,81 @@
+package cert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// NewServerConfig creates server TLS configuration from the PEM encoded
+// certificate and key files. When caFile is set, clients are required to
+// present a certificate signed by one of the CAs in that bundle (mTLS).
+func NewServerConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("cert and key files required")
+	}
+
+	crt, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading key pair from %s and %s", certFile, keyFile)
+	}
+
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{crt},
+	}
+
+	if caFile != "" {
+		pool, err := LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
+
+// NewClientConfig creates client TLS configuration. When caFile is empty,
+// the host's root CA set is used to verify the server. When both certFile
+// and keyFile are set, that certificate is presented to the server (mTLS).
+func NewClientConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+
+	if caFile != "" {
+		pool, err := LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		crt, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error loading key pair from %s and %s", certFile, keyFile)
+		}
+		cfg.Certificates = []tls.Certificate{crt}
+	}
+
+	return cfg, nil
+}
+
+// LoadCertPool creates a certificate pool from the PEM encoded CA bundle file
+func LoadCertPool(caFile string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading CA file %s", caFile)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.Errorf("no valid certificates found in %s", caFile)
+	}
+	return pool, nil
+}
@@ -0,0 +1,213 @@
+package cert
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultReloadInterval is the default frequency of file change checks
+	DefaultReloadInterval = 30 * time.Second
+)
+
+// NewReloader creates a Reloader and loads the initial server TLS configuration
+func NewReloader(certFile, keyFile, caFile string, interval time.Duration) (*Reloader, error) {
+	if interval <= 0 {
+		interval = DefaultReloadInterval
+	}
+	r := &Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		interval: interval,
+	}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reloader keeps the server certificate and client CA pool loaded from the
+// cert, key, and CA files, and swaps them when their content changes. The
+// swap applies only to new handshakes so existing connections are not affected.
+type Reloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	interval time.Duration
+
+	lock    sync.Mutex
+	sum     []byte
+	current atomic.Value // *keyMaterial
+	reloads int64
+}
+
+type keyMaterial struct {
+	cert *tls.Certificate
+	pool *x509.CertPool
+}
+
+// Watch checks the files for changes until the context is canceled
+func (r *Reloader) Watch(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := r.reload()
+			if err != nil {
+				log.Errorf("error reloading TLS certificates: %v", err)
+				continue
+			}
+			if changed {
+				log.Infof("reloaded TLS certificates from %s (reloads: %d)", r.certFile, r.ReloadCount())
+			}
+		}
+	}
+}
+
+// ServerConfig returns TLS configuration which resolves to the most recently
+// loaded certificate and, when the CA file is set, verifies client
+// certificates against the most recently loaded CA pool (mTLS).
+func (r *Reloader) ServerConfig() *tls.Config {
+	cfg := r.serverConfig()
+	if r.caFile != "" {
+		// verification is done in verifyClient against the current pool
+		cfg.ClientAuth = tls.RequireAnyClientCert
+		cfg.VerifyPeerCertificate = r.verifyClient
+	}
+	return cfg
+}
+
+// OptionalClientCertConfig returns ServerConfig which accepts connections
+// without a client certificate, and verifies the ones presented. Handlers
+// requiring mTLS must check the connection has the peer certificates.
+func (r *Reloader) OptionalClientCertConfig() *tls.Config {
+	cfg := r.serverConfig()
+	if r.caFile != "" {
+		cfg.ClientAuth = tls.RequestClientCert
+		cfg.VerifyPeerCertificate = func(raw [][]byte, chains [][]*x509.Certificate) error {
+			if len(raw) == 0 {
+				return nil
+			}
+			return r.verifyClient(raw, chains)
+		}
+	}
+	return cfg
+}
+
+// HasClientCAs returns true when client certificates are verified (mTLS)
+func (r *Reloader) HasClientCAs() bool {
+	return r.caFile != ""
+}
+
+func (r *Reloader) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return r.Certificate(), nil
+		},
+	}
+}
+
+// Certificate returns the most recently loaded server certificate
+func (r *Reloader) Certificate() *tls.Certificate {
+	return r.material().cert
+}
+
+// ReloadCount returns the number of times the certificates were reloaded
+func (r *Reloader) ReloadCount() int64 {
+	return atomic.LoadInt64(&r.reloads)
+}
+
+func (r *Reloader) verifyClient(raw [][]byte, _ [][]*x509.Certificate) error {
+	if len(raw) == 0 {
+		return errors.New("client certificate required")
+	}
+
+	certs := make([]*x509.Certificate, 0, len(raw))
+	for _, b := range raw {
+		c, err := x509.ParseCertificate(b)
+		if err != nil {
+			return errors.Wrap(err, "error parsing client certificate")
+		}
+		certs = append(certs, c)
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         r.material().pool,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, c := range certs[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+
+	if _, err := certs[0].Verify(opts); err != nil {
+		return errors.Wrap(err, "error verifying client certificate")
+	}
+	return nil
+}
+
+func (r *Reloader) material() *keyMaterial {
+	return r.current.Load().(*keyMaterial)
+}
+
+// reload loads the files when their content differs from the last load.
+// The new checksum is only recorded on success, so files caught mid-write
+// are retried on the next check.
+func (r *Reloader) reload() (bool, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	sum, err := r.checksum()
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(sum, r.sum) {
+		return false, nil
+	}
+
+	cfg, err := NewServerConfig(r.certFile, r.keyFile, r.caFile)
+	if err != nil {
+		return false, err
+	}
+	m := &keyMaterial{cert: &cfg.Certificates[0], pool: cfg.ClientCAs}
+
+	first := r.sum == nil
+	r.current.Store(m)
+	r.sum = sum
+	if first {
+		return false, nil
+	}
+	atomic.AddInt64(&r.reloads, 1)
+	return true, nil
+}
+
+func (r *Reloader) checksum() ([]byte, error) {
+	h := sha256.New()
+	for _, f := range []string{r.certFile, r.keyFile, r.caFile} {
+		if f == "" {
+			continue
+		}
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading %s", f)
+		}
+		h.Write(b)
+	}
+	return h.Sum(nil), nil
+}
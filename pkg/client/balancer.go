@@ -0,0 +1,85 @@
+package client
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer/roundrobin"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+)
+
+const (
+	// RoundRobin spreads the calls across all the server addresses
+	RoundRobin = roundrobin.Name
+	// PickFirst sends all the calls to the first server address it can connect to
+	PickFirst = grpc.PickFirstBalancerName
+
+	addressSeparator = ","
+	// addressScheme is the scheme of the resolver of the address lists, which
+	// is scoped to the connection
+	addressScheme = "ping-addresses"
+)
+
+func validateBalancer(name string) error {
+	switch name {
+	case "", RoundRobin, PickFirst:
+		return nil
+	}
+	return errors.Errorf("invalid balancer: %s (expected %s or %s)", name, RoundRobin, PickFirst)
+}
+
+// resolveTarget returns the target to dial. A comma separated list of
+// addresses is resolved by a static resolver passed in the returned options,
+// any other target is resolved by gRPC, e.g. dns:///ping.example.com:50505.
+// Each listed address is authenticated and addressed by its own host name.
+func resolveTarget(target string) (string, []grpc.DialOption, error) {
+	if !strings.Contains(target, addressSeparator) {
+		return target, nil, nil
+	}
+
+	addrs := make([]resolver.Address, 0)
+	for _, a := range strings.Split(target, addressSeparator) {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			return "", nil, errors.Errorf("invalid target, empty address: %s", target)
+		}
+		addrs = append(addrs, resolver.Address{Addr: a, ServerName: addressHost(a)})
+	}
+	r := manual.NewBuilderWithScheme(addressScheme)
+	r.InitialState(resolver.State{Addresses: addrs})
+	return addressScheme + ":///ping", []grpc.DialOption{grpc.WithResolvers(r)}, nil
+}
+
+// addressHost returns the host of the address, which is the TLS server name
+// and the authority of the calls sent to it
+func addressHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// serviceConfig returns the default service config JSON with the balancer
+// and the retry policy, or an empty string when neither is configured
+func (p *PingClient) serviceConfig() (string, error) {
+	cfg := make(map[string]interface{})
+	if p.balancer != "" {
+		cfg["loadBalancingConfig"] = []interface{}{map[string]interface{}{p.balancer: struct{}{}}}
+	}
+	if p.retryPolicy != nil && !p.retryPolicy.Hedging {
+		cfg["methodConfig"] = []interface{}{p.retryPolicy.methodConfig()}
+	}
+	if len(cfg) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return "", errors.Wrap(err, "error encoding service config")
+	}
+	return string(b), nil
+}
@@ -0,0 +1,229 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// startReplicas starts the servers on bufconn listeners and returns their
+// addresses along with the dialer connecting to them
+func startReplicas(t *testing.T, servers ...*flakyServer) ([]string, grpc.DialOption) {
+	t.Helper()
+	return startReplicaServers(t, func(string) *grpc.Server { return grpc.NewServer() }, servers...)
+}
+
+// startTLSReplicas starts the servers with certificates valid only for their
+// own host names and returns the pool of the CAs which issued them
+func startTLSReplicas(t *testing.T, servers ...*flakyServer) ([]string, grpc.DialOption, *x509.CertPool) {
+	t.Helper()
+	pool := x509.NewCertPool()
+	addrs, dialer := startReplicaServers(t, func(addr string) *grpc.Server {
+		host, _, err := net.SplitHostPort(addr)
+		require.NoError(t, err)
+		cert := selfSignedCert(t, host)
+		pool.AddCert(cert.Leaf)
+		return grpc.NewServer(grpc.Creds(credentials.NewServerTLSFromCert(&cert)))
+	}, servers...)
+	return addrs, dialer, pool
+}
+
+func startReplicaServers(t *testing.T, newServer func(addr string) *grpc.Server, servers ...*flakyServer) ([]string, grpc.DialOption) {
+	t.Helper()
+	listeners := make(map[string]*bufconn.Listener)
+	addrs := make([]string, 0, len(servers))
+	for i, srv := range servers {
+		addr := fmt.Sprintf("replica-%d:50505", i)
+		lis := bufconn.Listen(1024 * 1024)
+		s := newServer(addr)
+		pb.RegisterServiceServer(s, srv)
+		go func() { _ = s.Serve(lis) }()
+		t.Cleanup(s.Stop)
+
+		listeners[addr] = lis
+		addrs = append(addrs, addr)
+	}
+	dialer := func(ctx context.Context, addr string) (net.Conn, error) {
+		lis, ok := listeners[addr]
+		if !ok {
+			return nil, fmt.Errorf("unknown address: %s", addr)
+		}
+		return lis.DialContext(ctx)
+	}
+	return addrs, grpc.WithContextDialer(dialer)
+}
+
+func selfSignedCert(t *testing.T, host string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: host},
+		DNSNames:              []string{host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func pingN(t *testing.T, c *PingClient, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		_, _, err := c.Ping(context.Background(), "test")
+		require.NoError(t, err)
+	}
+}
+
+// waitForReplicas pings until every server got a call, so all the connections
+// are ready, and resets the call counts
+func waitForReplicas(t *testing.T, c *PingClient, servers []*flakyServer) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		if _, _, err := c.Ping(context.Background(), "test"); err != nil {
+			return false
+		}
+		for _, srv := range servers {
+			if atomic.LoadInt32(&srv.calls) == 0 {
+				return false
+			}
+		}
+		return true
+	}, time.Second, time.Millisecond)
+	for _, srv := range servers {
+		atomic.StoreInt32(&srv.calls, 0)
+	}
+}
+
+func TestBalancer(t *testing.T) {
+	t.Run("round robin", func(t *testing.T) {
+		servers := []*flakyServer{{}, {}, {}}
+		addrs, dialer := startReplicas(t, servers...)
+		c, err := NewPingClient(context.Background(), strings.Join(addrs, ","), "test",
+			WithBalancer(RoundRobin), WithDialOptions(dialer))
+		require.NoError(t, err)
+		t.Cleanup(c.Close)
+
+		waitForReplicas(t, c, servers)
+		pingN(t, c, 30)
+		for i, srv := range servers {
+			assert.Equal(t, int32(10), atomic.LoadInt32(&srv.calls), "replica %d", i)
+		}
+	})
+
+	t.Run("pick first", func(t *testing.T) {
+		servers := []*flakyServer{{}, {}, {}}
+		addrs, dialer := startReplicas(t, servers...)
+		c, err := NewPingClient(context.Background(), strings.Join(addrs, ", "), "test",
+			WithBalancer(PickFirst), WithDialOptions(dialer))
+		require.NoError(t, err)
+		t.Cleanup(c.Close)
+
+		pingN(t, c, 10)
+		assert.Equal(t, int32(10), atomic.LoadInt32(&servers[0].calls))
+		assert.Zero(t, atomic.LoadInt32(&servers[1].calls))
+		assert.Zero(t, atomic.LoadInt32(&servers[2].calls))
+	})
+
+	t.Run("resolver", func(t *testing.T) {
+		servers := []*flakyServer{{}, {}}
+		addrs, dialer := startReplicas(t, servers...)
+		r := manual.NewBuilderWithScheme("test")
+		r.InitialState(resolver.State{Addresses: []resolver.Address{{Addr: addrs[0]}, {Addr: addrs[1]}}})
+		c, err := NewPingClient(context.Background(), "test:///ping", "test",
+			WithBalancer(RoundRobin), WithDialOptions(dialer, grpc.WithResolvers(r)))
+		require.NoError(t, err)
+		t.Cleanup(c.Close)
+
+		waitForReplicas(t, c, servers)
+		pingN(t, c, 10)
+		assert.Equal(t, int32(5), atomic.LoadInt32(&servers[0].calls))
+		assert.Equal(t, int32(5), atomic.LoadInt32(&servers[1].calls))
+	})
+
+	t.Run("tls", func(t *testing.T) {
+		servers := []*flakyServer{{}, {}}
+		addrs, dialer, pool := startTLSReplicas(t, servers...)
+		c, err := NewPingClient(context.Background(), strings.Join(addrs, ","), "test",
+			WithBalancer(RoundRobin), WithTLS(&tls.Config{RootCAs: pool}), WithDialOptions(dialer))
+		require.NoError(t, err)
+		t.Cleanup(c.Close)
+
+		// each replica is verified against its own host name
+		waitForReplicas(t, c, servers)
+		pingN(t, c, 10)
+		assert.Equal(t, int32(5), atomic.LoadInt32(&servers[0].calls))
+		assert.Equal(t, int32(5), atomic.LoadInt32(&servers[1].calls))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := NewPingClient(context.Background(), "a:1,b:2", "test", WithBalancer("random"))
+		assert.Error(t, err)
+		_, err = NewPingClient(context.Background(), "a:1,,b:2", "test")
+		assert.Error(t, err)
+	})
+}
+
+func TestServiceConfig(t *testing.T) {
+	p := DefaultRetryPolicy
+	hedging := DefaultRetryPolicy
+	hedging.Hedging = true
+	tests := []struct {
+		name   string
+		client *PingClient
+		keys   []string
+	}{
+		{name: "none", client: &PingClient{}},
+		{name: "hedging", client: &PingClient{retryPolicy: &hedging}},
+		{name: "balancer", client: &PingClient{balancer: RoundRobin}, keys: []string{"loadBalancingConfig"}},
+		{name: "retries", client: &PingClient{retryPolicy: &p}, keys: []string{"methodConfig"}},
+		{name: "both", client: &PingClient{balancer: PickFirst, retryPolicy: &p},
+			keys: []string{"loadBalancingConfig", "methodConfig"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := tt.client.serviceConfig()
+			require.NoError(t, err)
+			if len(tt.keys) == 0 {
+				assert.Empty(t, cfg)
+				return
+			}
+			var out map[string]interface{}
+			require.NoError(t, json.Unmarshal([]byte(cfg), &out))
+			keys := make([]string, 0)
+			for k := range out {
+				keys = append(keys, k)
+			}
+			assert.ElementsMatch(t, tt.keys, keys)
+		})
+	}
+}
@@ -0,0 +1,413 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// BenchPing benchmarks the unary Ping method
+	BenchPing = "ping"
+	// BenchStream benchmarks the Stream method, each worker sending over its own stream
+	BenchStream = "stream"
+
+	// DefaultBenchPayloadSize is the size of the message data unless configured
+	DefaultBenchPayloadSize = 64
+
+	benchPayloadChars = "abcdefghijklmnopqrstuvwxyz0123456789"
+	histogramBuckets  = 10
+)
+
+// BenchConfig configures the load generated by Bench
+type BenchConfig struct {
+	// Method is the benchmarked method, BenchPing or BenchStream
+	Method string
+	// Duration is how long the load is generated for
+	Duration time.Duration
+	// QPS is the target rate of the messages across all the workers. When 0 the
+	// workers send the next message as soon as the previous one is answered.
+	QPS int
+	// Concurrency is the number of workers sending messages, 1 when 0
+	Concurrency int
+	// PayloadSize is the size of the message data in bytes, DefaultBenchPayloadSize when 0
+	PayloadSize int
+}
+
+func (c *BenchConfig) validate() error {
+	if c.Method == "" {
+		c.Method = BenchPing
+	}
+	if c.Method != BenchPing && c.Method != BenchStream {
+		return errors.Errorf("invalid bench method: %s", c.Method)
+	}
+	if c.Duration <= 0 {
+		return errors.Errorf("bench duration must be positive: %v", c.Duration)
+	}
+	if c.QPS < 0 || c.Concurrency < 0 || c.PayloadSize < 0 {
+		return errors.New("bench QPS, concurrency, and payload size must not be negative")
+	}
+	if c.QPS > int(time.Second) {
+		return errors.Errorf("bench QPS must not exceed %d: %d", int(time.Second), c.QPS)
+	}
+	if c.Concurrency == 0 {
+		c.Concurrency = 1
+	}
+	if c.PayloadSize == 0 {
+		c.PayloadSize = DefaultBenchPayloadSize
+	}
+	return nil
+}
+
+// BenchReport is the result of the benchmark
+type BenchReport struct {
+	Method      string        `json:"method"`
+	Duration    time.Duration `json:"duration_ns"`
+	QPS         int           `json:"target_qps"`
+	Concurrency int           `json:"concurrency"`
+	PayloadSize int           `json:"payload_size"`
+	Requests    int           `json:"requests"`
+	Errors      int           `json:"errors"`
+	// ErrorCodes counts the errors by their code
+	ErrorCodes map[string]int `json:"error_codes,omitempty"`
+	// Throughput is the number of successful messages per second
+	Throughput float64 `json:"throughput"`
+	// RTT is the wall-clock latency from sending a message to receiving its response
+	RTT Latency `json:"rtt"`
+	// Server is the latency from the Sent timestamp of the request to the
+	// Processed timestamp of the response, which depends on the clocks of the
+	// client and server being in sync
+	Server Latency `json:"server"`
+}
+
+// Latency summarizes the latency samples
+type Latency struct {
+	Count   int           `json:"count"`
+	Min     time.Duration `json:"min_ns"`
+	Mean    time.Duration `json:"mean_ns"`
+	Max     time.Duration `json:"max_ns"`
+	P50     time.Duration `json:"p50_ns"`
+	P90     time.Duration `json:"p90_ns"`
+	P99     time.Duration `json:"p99_ns"`
+	P999    time.Duration `json:"p999_ns"`
+	Buckets []Bucket      `json:"buckets,omitempty"`
+}
+
+// Bucket counts the samples up to its upper bound and above the previous one
+type Bucket struct {
+	UpperBound time.Duration `json:"le_ns"`
+	Count      int           `json:"count"`
+}
+
+// newLatency computes the percentiles and the histogram of the samples, which
+// it sorts. Buckets grow exponentially from the min to the max sample.
+func newLatency(samples []time.Duration) Latency {
+	l := Latency{Count: len(samples)}
+	if len(samples) == 0 {
+		return l
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+
+	var sum time.Duration
+	for _, s := range samples {
+		sum += s
+	}
+	l.Min = samples[0]
+	l.Max = samples[len(samples)-1]
+	l.Mean = sum / time.Duration(len(samples))
+	l.P50 = percentile(samples, 50)
+	l.P90 = percentile(samples, 90)
+	l.P99 = percentile(samples, 99)
+	l.P999 = percentile(samples, 99.9)
+
+	low := math.Max(float64(l.Min), 1)
+	factor := math.Pow(float64(l.Max)/low, 1.0/histogramBuckets)
+	i := 0
+	for b := 1; b <= histogramBuckets; b++ {
+		bound := time.Duration(low * math.Pow(factor, float64(b)))
+		if b == histogramBuckets || bound > l.Max {
+			bound = l.Max
+		}
+		n := 0
+		for i < len(samples) && samples[i] <= bound {
+			n++
+			i++
+		}
+		if n > 0 {
+			l.Buckets = append(l.Buckets, Bucket{UpperBound: bound, Count: n})
+		}
+	}
+	return l
+}
+
+// percentile returns the nearest-rank percentile of the sorted samples
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	// the epsilon keeps float errors, e.g. in 99.9%, from skipping a rank
+	rank := int(math.Ceil(p/100*float64(len(sorted)) - 1e-9))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// WriteJSON writes the report as indented JSON
+func (r *BenchReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return errors.Wrap(enc.Encode(r), "error encoding bench report")
+}
+
+// WriteText writes the report in a human readable form
+func (r *BenchReport) WriteText(w io.Writer) error {
+	var b strings.Builder
+	rate := "unlimited"
+	if r.QPS > 0 {
+		rate = fmt.Sprintf("%d qps", r.QPS)
+	}
+	fmt.Fprintf(&b, "method:      %s (%s, %d workers, %d byte payload)\n", r.Method, rate, r.Concurrency, r.PayloadSize)
+	fmt.Fprintf(&b, "duration:    %v\n", r.Duration.Round(time.Millisecond))
+	fmt.Fprintf(&b, "requests:    %d (%d errors)\n", r.Requests, r.Errors)
+	for _, c := range sortedKeys(r.ErrorCodes) {
+		fmt.Fprintf(&b, "  %-24s %d\n", c, r.ErrorCodes[c])
+	}
+	fmt.Fprintf(&b, "throughput:  %.1f msg/s\n", r.Throughput)
+	writeLatency(&b, "rtt", r.RTT)
+	writeLatency(&b, "server (sent to processed)", r.Server)
+	_, err := io.WriteString(w, b.String())
+	return errors.Wrap(err, "error writing bench report")
+}
+
+func writeLatency(b *strings.Builder, name string, l Latency) {
+	fmt.Fprintf(b, "\n%s latency (%d samples):\n", name, l.Count)
+	if l.Count == 0 {
+		return
+	}
+	fmt.Fprintf(b, "  min %v  mean %v  max %v\n", l.Min, l.Mean, l.Max)
+	fmt.Fprintf(b, "  p50 %v  p90 %v  p99 %v  p999 %v\n", l.P50, l.P90, l.P99, l.P999)
+	const width = 40
+	for _, bk := range l.Buckets {
+		bar := int(math.Ceil(float64(bk.Count) / float64(l.Count) * width))
+		fmt.Fprintf(b, "  <= %-14v %8d %s\n", bk.UpperBound, bk.Count, strings.Repeat("#", bar))
+	}
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// benchSample is the outcome of a single benchmarked message
+type benchSample struct {
+	rtt    time.Duration
+	server time.Duration
+	err    error
+}
+
+// benchResults collects the samples of all the workers
+type benchResults struct {
+	lock   sync.Mutex
+	rtt    []time.Duration
+	server []time.Duration
+	total  int
+	codes  map[string]int
+}
+
+func (r *benchResults) add(s benchSample) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.total++
+	if s.err != nil {
+		r.codes[status.Code(s.err).String()]++
+		return
+	}
+	r.rtt = append(r.rtt, s.rtt)
+	if s.server >= 0 {
+		r.server = append(r.server, s.server)
+	}
+}
+
+// Bench drives the configured method for the duration, at the target rate or
+// as fast as the workers can, and reports the throughput and latencies. Calls
+// canceled when the duration ends are not counted.
+func (p *PingClient) Bench(ctx context.Context, cfg BenchConfig) (*BenchReport, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, cfg.PayloadSize)
+	for i := range payload {
+		payload[i] = benchPayloadChars[i%len(benchPayloadChars)]
+	}
+
+	// ticks paces the workers at the target rate, ticks no worker is free to
+	// take are dropped so the rate is never exceeded
+	var ticks <-chan time.Time
+	if cfg.QPS > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(cfg.QPS))
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	benchCtx, cancel := context.WithTimeout(ctx, cfg.Duration)
+	defer cancel()
+	results := &benchResults{codes: make(map[string]int)}
+	worker := p.pingWorker
+	if cfg.Method == BenchStream {
+		worker = p.streamWorker
+	}
+
+	log.Debugf("benchmarking %s for %v with %d workers", cfg.Method, cfg.Duration, cfg.Concurrency)
+	start := time.Now()
+	var wg sync.WaitGroup
+	errCh := make(chan error, cfg.Concurrency)
+	for i := 0; i < cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			next := func() bool {
+				if ticks == nil {
+					return benchCtx.Err() == nil
+				}
+				select {
+				case <-ticks:
+					return true
+				case <-benchCtx.Done():
+					return false
+				}
+			}
+			if err := worker(benchCtx, string(payload), next, results); err != nil {
+				errCh <- err
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(errCh)
+	if err := <-errCh; err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "benchmark canceled")
+	}
+
+	report := &BenchReport{
+		Method:      cfg.Method,
+		Duration:    elapsed,
+		QPS:         cfg.QPS,
+		Concurrency: cfg.Concurrency,
+		PayloadSize: cfg.PayloadSize,
+		Requests:    results.total,
+		Errors:      results.total - len(results.rtt),
+		RTT:         newLatency(results.rtt),
+		Server:      newLatency(results.server),
+		Throughput:  float64(len(results.rtt)) / elapsed.Seconds(),
+	}
+	if len(results.codes) > 0 {
+		report.ErrorCodes = results.codes
+	}
+	return report, nil
+}
+
+// benchDone reports whether the error was caused by the end of the benchmark
+func benchDone(ctx context.Context, err error) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+	c := status.Code(err)
+	return c == codes.DeadlineExceeded || c == codes.Canceled
+}
+
+// serverLatency returns the latency from the request being sent to it being
+// processed, or -1 when the response has no processing time
+func serverLatency(req *pb.PingRequest, res *pb.PingResponse) time.Duration {
+	if res.GetProcessed() == 0 {
+		return -1
+	}
+	d := time.Duration(res.GetProcessed() - req.GetSent())
+	if d < 0 {
+		// clock skew between the client and the server
+		return 0
+	}
+	return d
+}
+
+// pingWorker sends a Ping for each tick until the benchmark ends. Pings
+// exceeding the client timeout count as errors.
+func (p *PingClient) pingWorker(ctx context.Context, msg string, next func() bool, results *benchResults) error {
+	for i := 0; next(); i++ {
+		req := p.MakeRequest(msg, i)
+		start := time.Now()
+		callCtx, cancel := withTimeout(ctx, p.timeouts.call)
+		res, err := p.client.Ping(callCtx, req)
+		cancel()
+		if benchDone(ctx, err) {
+			return nil
+		}
+		s := benchSample{rtt: time.Since(start), err: err}
+		if err == nil {
+			s.server = serverLatency(req, res)
+		}
+		results.add(s)
+	}
+	return nil
+}
+
+// streamWorker opens a stream and sends a message over it for each tick,
+// waiting for its response before sending the next one, until the benchmark
+// ends. Messages failing with the Error result count as errors.
+func (p *PingClient) streamWorker(ctx context.Context, msg string, next func() bool, results *benchResults) error {
+	stream, err := p.client.Stream(ctx)
+	if err != nil {
+		if benchDone(ctx, err) {
+			return nil
+		}
+		return errors.Wrap(err, "error creating stream")
+	}
+	defer func() {
+		if err := stream.CloseSend(); err != nil {
+			log.Debugf("error closing bench stream: %v", err)
+		}
+	}()
+
+	for i := 0; next(); i++ {
+		req := p.MakeRequest(msg, i)
+		start := time.Now()
+		if err := stream.Send(req); err != nil {
+			_, err = stream.Recv()
+			if benchDone(ctx, err) {
+				return nil
+			}
+			return errors.Wrap(err, "error sending stream request")
+		}
+		res, err := stream.Recv()
+		if benchDone(ctx, err) {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "error receiving stream response")
+		}
+		s := benchSample{rtt: time.Since(start)}
+		if res.GetResult() == pb.PingResponse_Error {
+			s.err = status.Error(codes.InvalidArgument, res.GetErrorMessage())
+		} else {
+			s.server = serverLatency(req, res)
+		}
+		results.add(s)
+	}
+	return nil
+}
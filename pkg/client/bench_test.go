@@ -0,0 +1,124 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+func TestBench(t *testing.T) {
+	ctx := context.Background()
+
+	for _, method := range []string{BenchPing, BenchStream} {
+		t.Run(method, func(t *testing.T) {
+			c := startFlakyServer(t, &flakyServer{})
+			r, err := c.Bench(ctx, BenchConfig{Method: method, Duration: 200 * time.Millisecond, Concurrency: 4})
+			require.NoError(t, err)
+			assert.Equal(t, method, r.Method)
+			assert.Equal(t, DefaultBenchPayloadSize, r.PayloadSize)
+			assert.Positive(t, r.Requests)
+			assert.Zero(t, r.Errors)
+			assert.Equal(t, r.Requests, r.RTT.Count)
+			assert.Equal(t, r.Requests, r.Server.Count)
+			assert.Positive(t, r.Throughput)
+			assert.LessOrEqual(t, r.RTT.P50, r.RTT.P99)
+		})
+	}
+
+	t.Run("qps", func(t *testing.T) {
+		c := startFlakyServer(t, &flakyServer{})
+		r, err := c.Bench(ctx, BenchConfig{Duration: 500 * time.Millisecond, QPS: 20, Concurrency: 2})
+		require.NoError(t, err)
+		assert.InDelta(t, 10, r.Requests, 2, "the rate is never exceeded")
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		c := startFlakyServer(t, &flakyServer{failures: 3, code: codes.Unavailable})
+		r, err := c.Bench(ctx, BenchConfig{Duration: 100 * time.Millisecond})
+		require.NoError(t, err)
+		assert.Equal(t, 3, r.Errors)
+		assert.Equal(t, map[string]int{"Unavailable": 3}, r.ErrorCodes)
+		assert.Equal(t, r.Requests-3, r.RTT.Count)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		c := startFlakyServer(t, &flakyServer{slow: map[int32]bool{1: true}}, WithTimeout(20*time.Millisecond))
+		r, err := c.Bench(ctx, BenchConfig{Duration: 200 * time.Millisecond})
+		require.NoError(t, err)
+		assert.Equal(t, map[string]int{"DeadlineExceeded": 1}, r.ErrorCodes)
+		assert.Positive(t, r.RTT.Count, "the worker is not blocked by the slow ping")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		c := startFlakyServer(t, &flakyServer{})
+		for _, cfg := range []BenchConfig{
+			{Duration: 0},
+			{Duration: time.Second, Method: "nope"},
+			{Duration: time.Second, QPS: -1},
+			{Duration: time.Second, QPS: int(time.Second) + 1},
+		} {
+			_, err := c.Bench(ctx, cfg)
+			assert.Error(t, err, cfg)
+		}
+	})
+}
+
+func TestLatency(t *testing.T) {
+	samples := make([]time.Duration, 0, 1000)
+	for i := 1000; i > 0; i-- {
+		samples = append(samples, time.Duration(i)*time.Millisecond)
+	}
+	l := newLatency(samples)
+	assert.Equal(t, 1000, l.Count)
+	assert.Equal(t, time.Millisecond, l.Min)
+	assert.Equal(t, time.Second, l.Max)
+	assert.Equal(t, 500*time.Millisecond, l.P50)
+	assert.Equal(t, 900*time.Millisecond, l.P90)
+	assert.Equal(t, 990*time.Millisecond, l.P99)
+	assert.Equal(t, 999*time.Millisecond, l.P999)
+	assert.Equal(t, 500500*time.Microsecond, l.Mean)
+
+	var n int
+	for i, b := range l.Buckets {
+		n += b.Count
+		if i > 0 {
+			assert.Greater(t, b.UpperBound, l.Buckets[i-1].UpperBound)
+		}
+	}
+	assert.Equal(t, 1000, n, "buckets cover all the samples")
+	assert.Equal(t, time.Second, l.Buckets[len(l.Buckets)-1].UpperBound)
+
+	assert.Equal(t, Latency{}, newLatency(nil))
+	assert.Equal(t, time.Millisecond, newLatency([]time.Duration{time.Millisecond}).P999)
+}
+
+func TestBenchReport(t *testing.T) {
+	r := &BenchReport{
+		Method:     BenchPing,
+		Duration:   time.Second,
+		Requests:   3,
+		Errors:     1,
+		ErrorCodes: map[string]int{"Unavailable": 1},
+		Throughput: 2,
+		RTT:        newLatency([]time.Duration{time.Millisecond, 2 * time.Millisecond}),
+	}
+
+	var text bytes.Buffer
+	require.NoError(t, r.WriteText(&text))
+	assert.Contains(t, text.String(), "requests:    3 (1 errors)")
+	assert.Contains(t, text.String(), "Unavailable")
+	assert.Contains(t, text.String(), "p50 1ms")
+
+	var buf bytes.Buffer
+	require.NoError(t, r.WriteJSON(&buf))
+	var out map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &out))
+	assert.Equal(t, float64(3), out["requests"])
+	assert.Equal(t, float64(time.Millisecond), out["rtt"].(map[string]interface{})["p50_ns"])
+}
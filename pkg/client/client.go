@@ -2,40 +2,111 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
+	"sort"
+	"sync"
 	"time"
 
 	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
 	"github.com/mchmarny/grpc-lab/pkg/id"
+	"github.com/mchmarny/grpc-lab/pkg/tracing"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 const (
-	timeOutInSec = 5
+	// DefaultTimeout is the deadline of the unary calls unless configured
+	DefaultTimeout = 5 * time.Second
+	// DefaultStreamIdleTimeout is how long a stream can go without sending or
+	// receiving a message unless configured
+	DefaultStreamIdleTimeout = 5 * time.Second
+
+	clientIDKey  = "client-id"
+	processorKey = "processor"
 )
 
-// NewPingClient creates a new instance of the ping client
-func NewPingClient(ctx context.Context, target, clientID string) (client *PingClient, err error) {
+// NewPingClient creates a new instance of the ping client. The target is a
+// server address, a comma separated list of addresses, or any target gRPC
+// resolves, e.g. dns:///ping.example.com:50505.
+func NewPingClient(ctx context.Context, target, clientID string, opts ...Option) (client *PingClient, err error) {
 	if target == "" {
 		return nil, errors.New("target required")
 	}
+
+	client = &PingClient{
+		target:         target,
+		id:             clientID,
+		tracerProvider: otel.GetTracerProvider(),
+		timeouts: timeouts{
+			call:       DefaultTimeout,
+			streamIdle: DefaultStreamIdleTimeout,
+		},
+	}
+	for _, opt := range opts {
+		opt(client)
+	}
+
 	// dialing options
-	opt := grpc.WithInsecure()
+	dialOpts := []grpc.DialOption{grpc.WithInsecure()}
+	if client.tlsConfig != nil {
+		dialOpts = []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(client.tlsConfig))}
+	}
+	otelOpts := []otelgrpc.Option{
+		otelgrpc.WithTracerProvider(client.tracerProvider),
+		otelgrpc.WithPropagators(tracing.Propagator()),
+	}
+	dialOpts = append(dialOpts,
+		grpc.WithChainUnaryInterceptor(
+			otelgrpc.UnaryClientInterceptor(otelOpts...),
+			client.unaryClientIDInterceptor,
+		),
+		grpc.WithChainStreamInterceptor(
+			otelgrpc.StreamClientInterceptor(otelOpts...),
+			client.streamClientIDInterceptor,
+		),
+	)
+	if client.retryPolicy != nil {
+		retryOpts, err := client.retryPolicy.dialOptions()
+		if err != nil {
+			return nil, err
+		}
+		dialOpts = append(dialOpts, retryOpts...)
+	}
+	if err := validateBalancer(client.balancer); err != nil {
+		return nil, err
+	}
+	cfg, err := client.serviceConfig()
+	if err != nil {
+		return nil, err
+	}
+	if cfg != "" {
+		dialOpts = append(dialOpts, grpc.WithDefaultServiceConfig(cfg))
+	}
+	dialTarget, resolverOpts, err := resolveTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	dialOpts = append(dialOpts, resolverOpts...)
+	dialOpts = append(dialOpts, client.dialOpts...)
+
 	log.Infof("dialing: %s...)", target)
-	conn, err := grpc.Dial(target, opt)
+	conn, err := grpc.DialContext(ctx, dialTarget, dialOpts...)
 	if err != nil {
 		return nil, errors.Wrap(err, "error dialing")
 	}
 
-	client = &PingClient{
-		conn:   conn,
-		client: pb.NewServiceClient(conn),
-		target: target,
-		id:     clientID,
-	}
+	client.conn = conn
+	client.client = pb.NewServiceClient(conn)
 	return
 }
 
@@ -45,29 +116,41 @@ type PingClient struct {
 	client pb.ServiceClient
 	target string
 	id     string
+
+	tlsConfig      *tls.Config
+	dialOpts       []grpc.DialOption
+	tracerProvider trace.TracerProvider
+	processor      string
+	retryPolicy    *RetryPolicy
+	timeouts       timeouts
+	balancer       string
 }
 
 // MakeRequest creates a request from message
 func (p *PingClient) MakeRequest(msg string, index int) *pb.PingRequest {
-	return &pb.PingRequest{
+	req := &pb.PingRequest{
 		Sent: time.Now().UTC().UnixNano(),
 		Content: &pb.Content{
 			Id:   id.NewID(),
 			Data: []byte(msg),
 			Metadata: map[string]string{
-				"client-id":     p.id,
+				clientIDKey:     p.id,
 				"created-on":    time.Now().UTC().Format(time.RFC3339),
 				"message-index": fmt.Sprintf("%d", index),
 			},
 		},
 	}
+	if p.processor != "" {
+		req.Content.Metadata[processorKey] = p.processor
+	}
+	return req
 }
 
 // Ping sends messages to the server
-func (p *PingClient) Ping(ctx context.Context, msg string) (out string, count int64, err error) {
+func (p *PingClient) Ping(ctx context.Context, msg string, opts ...CallOption) (out string, count int64, err error) {
 	req := p.MakeRequest(msg, 0)
 
-	pingCtx, cancel := context.WithTimeout(ctx, timeOutInSec*time.Second)
+	pingCtx, cancel := withTimeout(ctx, p.callTimeouts(opts).call)
 	defer cancel()
 
 	resp, err := p.client.Ping(pingCtx, req)
@@ -77,15 +160,134 @@ func (p *PingClient) Ping(ctx context.Context, msg string) (out string, count in
 	return resp.Detail, resp.MessageCount, nil
 }
 
-// StreamList streams messages from the client
-func (p *PingClient) StreamList(ctx context.Context, list []string) error {
-	pingCtx, cancel := context.WithTimeout(ctx, timeOutInSec*time.Second)
+// StreamList streams messages from the client and returns the responses in
+// the order they were received. Messages the server failed to process have
+// the Error result set while the rest of the stream continues.
+func (p *PingClient) StreamList(ctx context.Context, list []string, opts ...CallOption) ([]*pb.PingResponse, error) {
+	results := make([]*pb.PingResponse, 0, len(list))
+	_, err := p.StreamEach(ctx, list, func(r *StreamResult) {
+		if r.Response != nil {
+			results = append(results, r.Response)
+		}
+	}, opts...)
+	return results, err
+}
+
+// StreamResult is the response to a streamed message matched to its request
+type StreamResult struct {
+	// Index is the position of the message in the streamed list
+	Index int
+	// Request is the sent request
+	Request *pb.PingRequest
+	// Response is the response with the MessageID of the request, nil when missing
+	Response *pb.PingResponse
+	// RTT is the time from sending the request to receiving its response
+	RTT time.Duration
+	// OutOfOrder is set when the response arrived after the response to a
+	// message sent later
+	OutOfOrder bool
+	// Missing is set when the stream ended without a response to the message
+	Missing bool
+}
+
+// StreamSummary counts the results of the stream
+type StreamSummary struct {
+	Sent       int
+	Received   int
+	Failed     int
+	Missing    int
+	OutOfOrder int
+	// Unmatched counts the responses with a MessageID of no pending request,
+	// e.g. duplicate responses or messages from the other members of a room
+	Unmatched int
+}
+
+// streamPending tracks the sent messages waiting for their responses
+type streamPending struct {
+	lock      sync.Mutex
+	requests  map[string]*StreamResult
+	sent      map[string]time.Time
+	lastIndex int
+}
+
+func (s *streamPending) add(r *StreamResult) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	id := r.Request.GetContent().GetId()
+	s.requests[id] = r
+	s.sent[id] = time.Now()
+}
+
+// match returns the result of the response, or nil when no request is waiting for it
+func (s *streamPending) match(res *pb.PingResponse) *StreamResult {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r, ok := s.requests[res.GetMessageID()]
+	if !ok {
+		return nil
+	}
+	delete(s.requests, res.GetMessageID())
+	r.Response = res
+	r.RTT = time.Since(s.sent[res.GetMessageID()])
+	r.OutOfOrder = r.Index < s.lastIndex
+	if r.Index > s.lastIndex {
+		s.lastIndex = r.Index
+	}
+	return r
+}
+
+// missing returns the results of the requests left without a response, in the sent order
+func (s *streamPending) missing() []*StreamResult {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	list := make([]*StreamResult, 0, len(s.requests))
+	for _, r := range s.requests {
+		r.Missing = true
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Index < list[j].Index })
+	return list
+}
+
+// StreamEach streams messages from the client and calls fn with each response
+// matched to its request by the MessageID as it's received. Once the stream
+// ends fn is called for each message left without a response, with Missing
+// set, including when the stream fails. Calls to fn are never concurrent.
+// The stream fails with DeadlineExceeded when it's idle for longer than the
+// idle timeout or lasts longer than the stream timeout.
+func (p *PingClient) StreamEach(ctx context.Context, list []string, fn func(*StreamResult), opts ...CallOption) (*StreamSummary, error) {
+	if fn == nil {
+		return nil, errors.New("result func required")
+	}
+	t := p.callTimeouts(opts)
+	pingCtx, cancel := withTimeout(ctx, t.stream)
 	defer cancel()
+	idle := newIdleTimer(t.streamIdle, cancel)
+	defer idle.stop()
 
 	stream, err := p.client.Stream(pingCtx)
 	if err != nil {
-		return errors.Wrap(err, "error creating stream")
+		return nil, errors.Wrap(err, "error creating stream")
 	}
+	summary := &StreamSummary{}
+	pending := &streamPending{
+		requests:  make(map[string]*StreamResult, len(list)),
+		sent:      make(map[string]time.Time, len(list)),
+		lastIndex: -1,
+	}
+	finish := func(err error) (*StreamSummary, error) {
+		idle.stop()
+		if err != nil && idle.expired() {
+			err = errors.Wrap(status.Errorf(codes.DeadlineExceeded, "no messages for %v", t.streamIdle), "stream idle")
+		}
+		for _, r := range pending.missing() {
+			log.Warnf("no response to message %s", r.Request.GetContent().GetId())
+			summary.Missing++
+			fn(r)
+		}
+		return summary, err
+	}
+
 	waitResponse := make(chan error)
 	go func() {
 		for {
@@ -100,28 +302,65 @@ func (p *PingClient) StreamList(ctx context.Context, list []string) error {
 				return
 			}
 
+			idle.touch()
 			log.Debugf("received response: %+v", res)
+			r := pending.match(res)
+			if r == nil {
+				log.Debugf("unmatched response: %s", res.GetMessageID())
+				summary.Unmatched++
+				continue
+			}
+			summary.Received++
+			if res.GetResult() == pb.PingResponse_Error {
+				log.Warnf("message %s failed: %s", res.GetMessageID(), res.GetErrorMessage())
+				summary.Failed++
+			}
+			if r.OutOfOrder {
+				log.Warnf("message %s response out of order", res.GetMessageID())
+				summary.OutOfOrder++
+			}
+			fn(r)
 		}
 	}()
 
 	// send messages
 	for i, msg := range list {
 		req := p.MakeRequest(msg, i)
+		pending.add(&StreamResult{Index: i, Request: req})
 
 		sendErr := stream.Send(req)
 		if sendErr != nil {
-			return errors.Wrapf(sendErr, "error sending stream request: %v", stream.RecvMsg(nil))
+			// the receiving goroutine reports the error the stream failed with
+			err := <-waitResponse
+			return finish(errors.Wrapf(sendErr, "error sending stream request: %v", err))
 		}
-
+		idle.touch()
+		summary.Sent++
 		log.Debugf("sent request: %+v", req)
 	}
 
 	closeErr := stream.CloseSend()
 	if closeErr != nil {
-		return errors.Wrap(closeErr, "cannot close stream")
+		cancel()
+		<-waitResponse
+		return finish(errors.Wrap(closeErr, "cannot close stream"))
 	}
 
-	return <-waitResponse
+	return finish(<-waitResponse)
+}
+
+// unaryClientIDInterceptor identifies the client in the metadata of each call
+func (p *PingClient) unaryClientIDInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	ctx = metadata.AppendToOutgoingContext(ctx, clientIDKey, p.id)
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// streamClientIDInterceptor identifies the client in the metadata of each stream
+func (p *PingClient) streamClientIDInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+	method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	ctx = metadata.AppendToOutgoingContext(ctx, clientIDKey, p.id)
+	return streamer(ctx, desc, cc, method, opts...)
 }
 
 // Close cleans up resources
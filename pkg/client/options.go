@@ -0,0 +1,82 @@
+package client
+
+import (
+	"crypto/tls"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+)
+
+// Option configures the PingClient
+type Option func(*PingClient)
+
+// WithTLS dials the server using TLS with the provided configuration
+func WithTLS(cfg *tls.Config) Option {
+	return func(c *PingClient) {
+		c.tlsConfig = cfg
+	}
+}
+
+// WithDialOptions appends gRPC dial options used to create the connection
+func WithDialOptions(opts ...grpc.DialOption) Option {
+	return func(c *PingClient) {
+		c.dialOpts = append(c.dialOpts, opts...)
+	}
+}
+
+// WithTracerProvider sets the provider used to create client spans.
+// Defaults to the global provider.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(c *PingClient) {
+		c.tracerProvider = tp
+	}
+}
+
+// WithProcessor sets the processor pipeline the server applies to the message
+// data, e.g. reverse|upper. Defaults to the server default.
+func WithProcessor(spec string) Option {
+	return func(c *PingClient) {
+		c.processor = spec
+	}
+}
+
+// WithRetryPolicy retries the calls failing with the retryable codes, or hedges
+// the Ping calls when the policy enables hedging
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(c *PingClient) {
+		c.retryPolicy = &policy
+	}
+}
+
+// WithTimeout sets the deadline of the unary calls, DefaultTimeout unless set
+// and none when 0
+func WithTimeout(d time.Duration) Option {
+	return func(c *PingClient) {
+		c.timeouts.call = d
+	}
+}
+
+// WithStreamTimeout sets the deadline of the entire stream, none unless set
+func WithStreamTimeout(d time.Duration) Option {
+	return func(c *PingClient) {
+		c.timeouts.stream = d
+	}
+}
+
+// WithStreamIdleTimeout sets how long a stream can go without sending or
+// receiving a message before it's canceled, DefaultStreamIdleTimeout unless
+// set and unlimited when 0
+func WithStreamIdleTimeout(d time.Duration) Option {
+	return func(c *PingClient) {
+		c.timeouts.streamIdle = d
+	}
+}
+
+// WithBalancer sets the load balancing policy across the addresses the target
+// resolves to, RoundRobin or PickFirst (the gRPC default)
+func WithBalancer(name string) Option {
+	return func(c *PingClient) {
+		c.balancer = name
+	}
+}
@@ -0,0 +1,227 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	serviceName = "io.thingz.grpc.v1.Service"
+
+	// maxAttempts is the most attempts gRPC makes regardless of the policy
+	maxAttempts = 5
+)
+
+// DefaultRetryPolicy retries the calls failing with Unavailable up to 3 times
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:       4,
+	InitialBackoff:    100 * time.Millisecond,
+	MaxBackoff:        time.Second,
+	BackoffMultiplier: 2,
+	RetryableCodes:    []codes.Code{codes.Unavailable},
+}
+
+// RetryPolicy configures how the calls failing with a retryable code are
+// retried. Retries are done by gRPC based on the service config, so they also
+// cover streams which have not received a response yet.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts including the original call, up to 5
+	MaxAttempts int
+	// InitialBackoff is the backoff before the first retry, randomized by gRPC
+	InitialBackoff time.Duration
+	// MaxBackoff caps the backoff growing by BackoffMultiplier after each retry
+	MaxBackoff time.Duration
+	// BackoffMultiplier grows the backoff after each retry
+	BackoffMultiplier float64
+	// RetryableCodes are the codes of the failed calls which are retried
+	RetryableCodes []codes.Code
+	// Hedging sends up to MaxAttempts concurrent attempts of the unary calls,
+	// HedgingDelay apart, and uses the first response instead of waiting for an
+	// attempt to fail. The server deduplicates the pings by the content ID.
+	Hedging bool
+	// HedgingDelay is the time after which the next hedged call is sent
+	HedgingDelay time.Duration
+}
+
+func (p RetryPolicy) validate() error {
+	if p.MaxAttempts < 2 || p.MaxAttempts > maxAttempts {
+		return errors.Errorf("max attempts must be between 2 and %d: %d", maxAttempts, p.MaxAttempts)
+	}
+	if len(p.RetryableCodes) == 0 {
+		return errors.New("retryable codes required")
+	}
+	if p.Hedging {
+		if p.HedgingDelay <= 0 {
+			return errors.Errorf("hedging delay must be positive: %v", p.HedgingDelay)
+		}
+		return nil
+	}
+	if p.InitialBackoff <= 0 || p.MaxBackoff < p.InitialBackoff {
+		return errors.Errorf("invalid backoff: initial %v, max %v", p.InitialBackoff, p.MaxBackoff)
+	}
+	if p.BackoffMultiplier <= 0 {
+		return errors.Errorf("backoff multiplier must be positive: %v", p.BackoffMultiplier)
+	}
+	return nil
+}
+
+// ParseCodes parses the comma separated gRPC code names, e.g. UNAVAILABLE,ABORTED
+func ParseCodes(list string) ([]codes.Code, error) {
+	res := make([]codes.Code, 0)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		c, ok := code.Code_value[name]
+		if !ok {
+			return nil, errors.Errorf("invalid code: %s", name)
+		}
+		res = append(res, codes.Code(c))
+	}
+	return res, nil
+}
+
+// retryable reports whether calls failing with the code are retried
+func (p RetryPolicy) retryable(c codes.Code) bool {
+	for _, rc := range p.RetryableCodes {
+		if rc == c {
+			return true
+		}
+	}
+	return false
+}
+
+// methodConfig returns the service config method config applying the policy
+// to all the methods of the ping service
+func (p RetryPolicy) methodConfig() map[string]interface{} {
+	names := make([]string, 0, len(p.RetryableCodes))
+	for _, c := range p.RetryableCodes {
+		names = append(names, code.Code_name[int32(c)])
+	}
+
+	return map[string]interface{}{
+		"name": []interface{}{map[string]string{"service": serviceName}},
+		"retryPolicy": map[string]interface{}{
+			"maxAttempts":          p.MaxAttempts,
+			"initialBackoff":       durationJSON(p.InitialBackoff),
+			"maxBackoff":           durationJSON(p.MaxBackoff),
+			"backoffMultiplier":    p.BackoffMultiplier,
+			"retryableStatusCodes": names,
+		},
+	}
+}
+
+// durationJSON formats the duration the way the service config expects, e.g. 0.1s
+func durationJSON(d time.Duration) string {
+	return fmt.Sprintf("%gs", d.Seconds())
+}
+
+// dialOptions returns the options applying the policy to the connection,
+// along with the method config in the service config unless hedging
+func (p RetryPolicy) dialOptions() ([]grpc.DialOption, error) {
+	if err := p.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid retry policy")
+	}
+	if p.Hedging {
+		return []grpc.DialOption{grpc.WithChainUnaryInterceptor(p.hedgingInterceptor)}, nil
+	}
+	return []grpc.DialOption{grpc.WithChainStreamInterceptor(callContextStreamInterceptor)}, nil
+}
+
+// callContextStreamInterceptor returns the call context from the stream
+// Context. gRPC stops retrying a stream once its Context is called, which the
+// tracing interceptor does for every message.
+func callContextStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+	method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	s, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &callContextStream{ClientStream: s, ctx: ctx}, nil
+}
+
+type callContextStream struct {
+	grpc.ClientStream
+	ctx context.Context
+}
+
+func (s *callContextStream) Context() context.Context {
+	return s.ctx
+}
+
+type attemptResult struct {
+	reply proto.Message
+	err   error
+}
+
+// hedgingInterceptor sends a new attempt of the call every hedging delay until
+// one succeeds, one fails with a code which is not retryable, or all the
+// attempts fail. Attempts which failed with a retryable code trigger the next
+// attempt right away.
+func (p RetryPolicy) hedgingInterceptor(ctx context.Context, method string, req, reply interface{},
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	out, ok := reply.(proto.Message)
+	if !ok {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan attemptResult, p.MaxAttempts)
+	attempt := func(n int) {
+		r := proto.Clone(out)
+		proto.Reset(r)
+		err := invoker(ctx, method, req, r, cc, opts...)
+		log.Debugf("hedged attempt %d of %s: %v", n, method, err)
+		results <- attemptResult{reply: r, err: err}
+	}
+
+	timer := time.NewTimer(p.HedgingDelay)
+	defer timer.Stop()
+	sent, pending := 1, 1
+	go attempt(sent)
+
+	var err error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				proto.Reset(out)
+				proto.Merge(out, res.reply)
+				return nil
+			}
+			err = res.err
+			if !p.retryable(status.Code(res.err)) {
+				return res.err
+			}
+			if !timer.Stop() {
+				// drain the fired timer so it can be reset
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		}
+
+		if sent < p.MaxAttempts && ctx.Err() == nil {
+			sent++
+			pending++
+			go attempt(sent)
+			timer.Reset(p.HedgingDelay)
+		}
+	}
+	return err
+}
@@ -0,0 +1,208 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// flakyServer fails the first calls with the code, and delays the responses
+// of the attempts listed in slow until the call is canceled
+type flakyServer struct {
+	pb.UnimplementedServiceServer
+	failures int32
+	code     codes.Code
+	slow     map[int32]bool
+	calls    int32
+}
+
+func (s *flakyServer) Ping(ctx context.Context, req *pb.PingRequest) (*pb.PingResponse, error) {
+	n := atomic.AddInt32(&s.calls, 1)
+	if s.slow[n] {
+		<-ctx.Done()
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+	if n <= s.failures {
+		return nil, status.Errorf(s.code, "attempt %d failed", n)
+	}
+	return &pb.PingResponse{
+		MessageID:    req.GetContent().GetId(),
+		Detail:       "ok",
+		MessageCount: int64(n),
+		Processed:    time.Now().UTC().UnixNano(),
+	}, nil
+}
+
+func (s *flakyServer) Stream(stream pb.Service_StreamServer) error {
+	if n := atomic.AddInt32(&s.calls, 1); n <= s.failures {
+		return status.Errorf(s.code, "attempt %d failed", n)
+	}
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return nil
+		}
+		res := &pb.PingResponse{MessageID: req.GetContent().GetId(), Processed: time.Now().UTC().UnixNano()}
+		if err := stream.Send(res); err != nil {
+			return err
+		}
+	}
+}
+
+func startFlakyServer(t *testing.T, srv *flakyServer, opts ...Option) *PingClient {
+	t.Helper()
+	lis := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer()
+	pb.RegisterServiceServer(s, srv)
+	go func() { _ = s.Serve(lis) }()
+	t.Cleanup(s.Stop)
+
+	dialer := func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	}
+	opts = append(opts, WithDialOptions(grpc.WithContextDialer(dialer)))
+	c, err := NewPingClient(context.Background(), "bufnet", "test", opts...)
+	require.NoError(t, err)
+	t.Cleanup(c.Close)
+	return c
+}
+
+func testRetryPolicy() RetryPolicy {
+	p := DefaultRetryPolicy
+	p.InitialBackoff = 10 * time.Millisecond
+	p.MaxBackoff = 50 * time.Millisecond
+	return p
+}
+
+func TestRetries(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("retried", func(t *testing.T) {
+		srv := &flakyServer{failures: 2, code: codes.Unavailable}
+		c := startFlakyServer(t, srv, WithRetryPolicy(testRetryPolicy()))
+		out, count, err := c.Ping(ctx, "test")
+		require.NoError(t, err)
+		assert.Equal(t, "ok", out)
+		assert.Equal(t, int64(3), count)
+		assert.Equal(t, int32(3), atomic.LoadInt32(&srv.calls))
+	})
+
+	t.Run("exhausted", func(t *testing.T) {
+		srv := &flakyServer{failures: 10, code: codes.Unavailable}
+		c := startFlakyServer(t, srv, WithRetryPolicy(testRetryPolicy()))
+		_, _, err := c.Ping(ctx, "test")
+		assert.Equal(t, codes.Unavailable, status.Code(errorCause(err)))
+		assert.Equal(t, int32(4), atomic.LoadInt32(&srv.calls))
+	})
+
+	t.Run("not retryable", func(t *testing.T) {
+		srv := &flakyServer{failures: 1, code: codes.InvalidArgument}
+		c := startFlakyServer(t, srv, WithRetryPolicy(testRetryPolicy()))
+		_, _, err := c.Ping(ctx, "test")
+		assert.Equal(t, codes.InvalidArgument, status.Code(errorCause(err)))
+		assert.Equal(t, int32(1), atomic.LoadInt32(&srv.calls))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		srv := &flakyServer{failures: 1, code: codes.Unavailable}
+		c := startFlakyServer(t, srv)
+		_, _, err := c.Ping(ctx, "test")
+		assert.Error(t, err)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&srv.calls))
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		srv := &flakyServer{failures: 2, code: codes.Unavailable}
+		c := startFlakyServer(t, srv, WithRetryPolicy(testRetryPolicy()))
+		results, err := c.StreamList(ctx, []string{"a", "b"})
+		require.NoError(t, err)
+		assert.Len(t, results, 2)
+		assert.Equal(t, int32(3), atomic.LoadInt32(&srv.calls))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, p := range []RetryPolicy{
+			{MaxAttempts: 1, RetryableCodes: []codes.Code{codes.Unavailable}},
+			{MaxAttempts: 6, RetryableCodes: []codes.Code{codes.Unavailable}},
+			{MaxAttempts: 2},
+			{MaxAttempts: 2, RetryableCodes: []codes.Code{codes.Unavailable}},
+			{MaxAttempts: 2, RetryableCodes: []codes.Code{codes.Unavailable}, Hedging: true},
+		} {
+			_, err := NewPingClient(ctx, "bufnet", "test", WithRetryPolicy(p))
+			assert.Error(t, err, "%+v", p)
+		}
+	})
+}
+
+func TestHedging(t *testing.T) {
+	ctx := context.Background()
+	policy := testRetryPolicy()
+	policy.Hedging = true
+	policy.HedgingDelay = 20 * time.Millisecond
+
+	t.Run("slow attempt", func(t *testing.T) {
+		srv := &flakyServer{slow: map[int32]bool{1: true}}
+		c := startFlakyServer(t, srv, WithRetryPolicy(policy))
+		start := time.Now()
+		out, count, err := c.Ping(ctx, "test")
+		require.NoError(t, err)
+		assert.Equal(t, "ok", out)
+		assert.Equal(t, int64(2), count, "the second attempt responds first")
+		assert.Less(t, time.Since(start), time.Second, "the slow attempt is not waited for")
+	})
+
+	t.Run("failed attempts", func(t *testing.T) {
+		srv := &flakyServer{failures: 2, code: codes.Unavailable}
+		c := startFlakyServer(t, srv, WithRetryPolicy(policy))
+		_, count, err := c.Ping(ctx, "test")
+		require.NoError(t, err)
+		assert.Equal(t, int64(3), count)
+	})
+
+	t.Run("not retryable", func(t *testing.T) {
+		srv := &flakyServer{failures: 1, code: codes.PermissionDenied}
+		c := startFlakyServer(t, srv, WithRetryPolicy(policy))
+		_, _, err := c.Ping(ctx, "test")
+		assert.Equal(t, codes.PermissionDenied, status.Code(errorCause(err)))
+	})
+
+	t.Run("exhausted", func(t *testing.T) {
+		srv := &flakyServer{failures: 10, code: codes.Unavailable}
+		c := startFlakyServer(t, srv, WithRetryPolicy(policy))
+		_, _, err := c.Ping(ctx, "test")
+		assert.Equal(t, codes.Unavailable, status.Code(errorCause(err)))
+		assert.Equal(t, int32(policy.MaxAttempts), atomic.LoadInt32(&srv.calls))
+	})
+}
+
+func TestParseCodes(t *testing.T) {
+	list, err := ParseCodes("unavailable, ABORTED,,")
+	require.NoError(t, err)
+	assert.Equal(t, []codes.Code{codes.Unavailable, codes.Aborted}, list)
+
+	_, err = ParseCodes("UNAVAILABLE,NOPE")
+	assert.Error(t, err)
+}
+
+// errorCause returns the gRPC status error wrapped by the client
+func errorCause(err error) error {
+	type causer interface{ Cause() error }
+	for err != nil {
+		c, ok := err.(causer)
+		if !ok {
+			break
+		}
+		err = c.Cause()
+	}
+	return err
+}
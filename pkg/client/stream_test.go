@@ -0,0 +1,132 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// reorderingServer receives all the streamed messages and responds to them
+// in the order of the indexes, delay apart, followed by a response to an
+// unknown message
+type reorderingServer struct {
+	pb.UnimplementedServiceServer
+	order []int
+	delay time.Duration
+	err   error
+}
+
+func (s *reorderingServer) Stream(stream pb.Service_StreamServer) error {
+	reqs := make([]*pb.PingRequest, 0)
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			break
+		}
+		reqs = append(reqs, req)
+	}
+	for _, i := range s.order {
+		time.Sleep(s.delay + time.Millisecond)
+		res := &pb.PingResponse{MessageID: reqs[i].GetContent().GetId(), Result: pb.PingResponse_Success}
+		if string(reqs[i].GetContent().GetData()) == "" {
+			res.Result = pb.PingResponse_Error
+		}
+		if err := stream.Send(res); err != nil {
+			return err
+		}
+	}
+	if err := stream.Send(&pb.PingResponse{MessageID: "unknown"}); err != nil {
+		return err
+	}
+	return s.err
+}
+
+func startReorderingServer(t *testing.T, srv *reorderingServer, opts ...Option) *PingClient {
+	t.Helper()
+	lis := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer()
+	pb.RegisterServiceServer(s, srv)
+	go func() { _ = s.Serve(lis) }()
+	t.Cleanup(s.Stop)
+
+	dialer := func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	}
+	opts = append(opts, WithDialOptions(grpc.WithContextDialer(dialer)))
+	c, err := NewPingClient(context.Background(), "bufnet", "test", opts...)
+	require.NoError(t, err)
+	t.Cleanup(c.Close)
+	return c
+}
+
+func TestStreamEach(t *testing.T) {
+	ctx := context.Background()
+	list := []string{"a", "b", "", "d", "e"}
+
+	t.Run("correlated", func(t *testing.T) {
+		c := startReorderingServer(t, &reorderingServer{order: []int{0, 3, 1, 2}})
+		results := make([]*StreamResult, 0)
+		summary, err := c.StreamEach(ctx, list, func(r *StreamResult) {
+			results = append(results, r)
+		})
+		require.NoError(t, err)
+		assert.Equal(t, &StreamSummary{Sent: 5, Received: 4, Failed: 1, Missing: 1, OutOfOrder: 2, Unmatched: 1}, summary)
+
+		require.Len(t, results, 5)
+		for i, want := range []struct {
+			index      int
+			outOfOrder bool
+		}{{0, false}, {3, false}, {1, true}, {2, true}} {
+			r := results[i]
+			assert.Equal(t, want.index, r.Index)
+			assert.Equal(t, list[want.index], string(r.Request.GetContent().GetData()))
+			assert.Equal(t, r.Request.GetContent().GetId(), r.Response.GetMessageID())
+			assert.Equal(t, want.outOfOrder, r.OutOfOrder, i)
+			assert.False(t, r.Missing)
+			assert.Positive(t, r.RTT)
+		}
+		assert.Equal(t, pb.PingResponse_Error, results[3].Response.GetResult())
+
+		missing := results[4]
+		assert.Equal(t, 4, missing.Index)
+		assert.True(t, missing.Missing)
+		assert.Nil(t, missing.Response)
+	})
+
+	t.Run("failed stream", func(t *testing.T) {
+		srv := &reorderingServer{order: []int{0}, err: status.Error(codes.Internal, "failed")}
+		c := startReorderingServer(t, srv)
+		var missing int
+		summary, err := c.StreamEach(ctx, list, func(r *StreamResult) {
+			if r.Missing {
+				missing++
+			}
+		})
+		assert.Equal(t, codes.Internal, status.Code(errorCause(err)))
+		assert.Equal(t, 4, missing, "messages without a response are reported when the stream fails")
+		assert.Equal(t, 4, summary.Missing)
+		assert.Equal(t, 1, summary.Received)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		c := startReorderingServer(t, &reorderingServer{order: []int{4, 3, 2, 1, 0}})
+		results, err := c.StreamList(ctx, list)
+		require.NoError(t, err)
+		assert.Len(t, results, 5, "only the matched responses are listed")
+	})
+
+	t.Run("no func", func(t *testing.T) {
+		c := startReorderingServer(t, &reorderingServer{})
+		_, err := c.StreamEach(ctx, list, nil)
+		assert.Error(t, err)
+	})
+}
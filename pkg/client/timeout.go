@@ -0,0 +1,98 @@
+package client
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// timeouts holds the deadlines applied to the calls, none when 0
+type timeouts struct {
+	// call is the deadline of the unary calls
+	call time.Duration
+	// stream is the deadline of the entire stream
+	stream time.Duration
+	// streamIdle is how long a stream can go without sending or receiving a message
+	streamIdle time.Duration
+}
+
+// CallOption overrides the client timeouts for a single call
+type CallOption func(*timeouts)
+
+// CallTimeout sets the deadline of the unary call, none when 0
+func CallTimeout(d time.Duration) CallOption {
+	return func(t *timeouts) {
+		t.call = d
+	}
+}
+
+// CallStreamTimeout sets the deadline of the entire stream, none when 0
+func CallStreamTimeout(d time.Duration) CallOption {
+	return func(t *timeouts) {
+		t.stream = d
+	}
+}
+
+// CallStreamIdleTimeout sets how long the stream can go without sending or
+// receiving a message, unlimited when 0
+func CallStreamIdleTimeout(d time.Duration) CallOption {
+	return func(t *timeouts) {
+		t.streamIdle = d
+	}
+}
+
+// callTimeouts returns the client timeouts overridden by the call options
+func (p *PingClient) callTimeouts(opts []CallOption) timeouts {
+	t := p.timeouts
+	for _, opt := range opts {
+		opt(&t)
+	}
+	return t
+}
+
+// withTimeout returns a context with the timeout, or a cancelable context when
+// the timeout is 0. Deadlines of the parent context still apply.
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// idleTimer cancels the call once it isn't touched for the timeout. A nil
+// timer, used when the timeout is 0, never expires.
+type idleTimer struct {
+	timeout time.Duration
+	timer   *time.Timer
+	fired   int32
+}
+
+func newIdleTimer(d time.Duration, cancel context.CancelFunc) *idleTimer {
+	if d <= 0 {
+		return nil
+	}
+	t := &idleTimer{timeout: d}
+	t.timer = time.AfterFunc(d, func() {
+		atomic.StoreInt32(&t.fired, 1)
+		cancel()
+	})
+	return t
+}
+
+// touch restarts the timeout
+func (t *idleTimer) touch() {
+	if t != nil {
+		t.timer.Reset(t.timeout)
+	}
+}
+
+// expired reports whether the timer canceled the call
+func (t *idleTimer) expired() bool {
+	return t != nil && atomic.LoadInt32(&t.fired) == 1
+}
+
+func (t *idleTimer) stop() {
+	if t != nil {
+		t.timer.Stop()
+	}
+}
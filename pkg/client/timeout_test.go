@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCallTimeout(t *testing.T) {
+	ctx := context.Background()
+	srv := &flakyServer{slow: map[int32]bool{1: true, 2: true, 3: true}}
+	c := startFlakyServer(t, srv, WithTimeout(50*time.Millisecond))
+
+	start := time.Now()
+	_, _, err := c.Ping(ctx, "test")
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(errorCause(err)))
+	assert.Less(t, time.Since(start), time.Second)
+
+	start = time.Now()
+	_, _, err = c.Ping(ctx, "test", CallTimeout(150*time.Millisecond))
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(errorCause(err)))
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond, "call options override the client timeout")
+
+	shortCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, _, err = c.Ping(shortCtx, "test", CallTimeout(0))
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(errorCause(err)))
+	assert.Less(t, time.Since(start), 150*time.Millisecond, "the context deadline still applies")
+
+	_, _, err = c.Ping(ctx, "test")
+	assert.NoError(t, err)
+}
+
+func TestStreamTimeouts(t *testing.T) {
+	ctx := context.Background()
+	list := []string{"a", "b", "c", "d", "e"}
+	order := []int{0, 1, 2, 3, 4}
+
+	t.Run("longer than idle", func(t *testing.T) {
+		srv := &reorderingServer{order: order, delay: 20 * time.Millisecond}
+		c := startReorderingServer(t, srv, WithStreamIdleTimeout(100*time.Millisecond))
+		summary, err := c.StreamEach(ctx, list, func(*StreamResult) {})
+		require.NoError(t, err, "streams are only limited by the idle timeout")
+		assert.Equal(t, 5, summary.Received)
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		srv := &reorderingServer{order: order, delay: 100 * time.Millisecond}
+		c := startReorderingServer(t, srv)
+		summary, err := c.StreamEach(ctx, list, func(*StreamResult) {}, CallStreamIdleTimeout(50*time.Millisecond))
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(errorCause(err)))
+		assert.True(t, strings.HasPrefix(err.Error(), "stream idle"), err)
+		assert.Equal(t, 5, summary.Missing)
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		srv := &reorderingServer{order: order, delay: 20 * time.Millisecond}
+		c := startReorderingServer(t, srv, WithStreamTimeout(50*time.Millisecond))
+		summary, err := c.StreamEach(ctx, list, func(*StreamResult) {})
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(errorCause(err)))
+		assert.False(t, strings.HasPrefix(err.Error(), "stream idle"), err)
+		assert.Positive(t, summary.Missing)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		srv := &reorderingServer{order: order, delay: 20 * time.Millisecond}
+		c := startReorderingServer(t, srv, WithStreamIdleTimeout(10*time.Millisecond))
+		_, err := c.StreamList(ctx, list, CallStreamIdleTimeout(0))
+		assert.NoError(t, err)
+	})
+}
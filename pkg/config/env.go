@@ -4,6 +4,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // GetEnvVar looks up env var and returns its value or fallback if not available
@@ -26,3 +27,29 @@ func GetEnvBoolVar(key string, fallbackValue bool) bool {
 	}
 	return fallbackValue
 }
+
+// GetEnvIntVar returns int parsed from env var based on the key or falls back to provided value
+func GetEnvIntVar(key string, fallbackValue int) int {
+	val, ok := os.LookupEnv(key)
+	if !ok {
+		return fallbackValue
+	}
+	i, err := strconv.Atoi(strings.TrimSpace(val))
+	if err == nil {
+		return i
+	}
+	return fallbackValue
+}
+
+// GetEnvDurationVar returns duration parsed from env var based on the key or falls back to provided value
+func GetEnvDurationVar(key string, fallbackValue time.Duration) time.Duration {
+	val, ok := os.LookupEnv(key)
+	if !ok {
+		return fallbackValue
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(val))
+	if err == nil {
+		return d
+	}
+	return fallbackValue
+}
@@ -0,0 +1,203 @@
+package format
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultPipeline is the pipeline used when none is selected
+	DefaultPipeline = "reverse"
+	// MaxPipelineStages is the max number of processors in a pipeline
+	MaxPipelineStages = 8
+
+	pipelineSeparator = "|"
+)
+
+// Processor transforms message data
+type Processor interface {
+	// Process returns the processed data, or an error when the data can't be processed
+	Process(data []byte) ([]byte, error)
+}
+
+// ProcessorFunc is a func usable as a Processor
+type ProcessorFunc func(data []byte) ([]byte, error)
+
+// Process calls the func
+func (f ProcessorFunc) Process(data []byte) ([]byte, error) {
+	return f(data)
+}
+
+// registered is a processor with the label describing what it did, e.g. Reversed
+type registered struct {
+	processor Processor
+	label     string
+}
+
+// Registry holds the named processors
+type Registry struct {
+	lock       sync.RWMutex
+	processors map[string]registered
+}
+
+// NewRegistry creates a registry with the built-in processors
+func NewRegistry() *Registry {
+	r := &Registry{processors: make(map[string]registered)}
+	for _, b := range builtins {
+		if err := r.Register(b.name, b.label, b.processor); err != nil {
+			panic(err)
+		}
+	}
+	return r
+}
+
+// Register adds the processor under the name, which must be unique and can't
+// contain the pipeline separator. The label describes what the processor did.
+func (r *Registry) Register(name, label string, p Processor) error {
+	if name == "" || strings.Contains(name, pipelineSeparator) {
+		return errors.Errorf("invalid processor name: %q", name)
+	}
+	if p == nil {
+		return errors.Errorf("processor required: %s", name)
+	}
+	if label == "" {
+		label = name
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.processors[name]; ok {
+		return errors.Errorf("processor already registered: %s", name)
+	}
+	r.processors[name] = registered{processor: p, label: label}
+	return nil
+}
+
+// Names returns the sorted names of the registered processors
+func (r *Registry) Names() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	names := make([]string, 0, len(r.processors))
+	for name := range r.processors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Pipeline returns the pipeline of the processors named in the spec, separated
+// by | and applied left to right (e.g. reverse|upper), up to MaxPipelineStages.
+// An empty spec returns the default pipeline.
+func (r *Registry) Pipeline(spec string) (*Pipeline, error) {
+	if strings.TrimSpace(spec) == "" {
+		spec = DefaultPipeline
+	}
+	names := strings.Split(spec, pipelineSeparator)
+	if len(names) > MaxPipelineStages {
+		return nil, errors.Errorf("too many processors: %d (max %d)", len(names), MaxPipelineStages)
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	p := &Pipeline{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		reg, ok := r.processors[name]
+		if !ok {
+			return nil, errors.Errorf("unknown processor: %q", name)
+		}
+		p.names = append(p.names, name)
+		p.labels = append(p.labels, reg.label)
+		p.processors = append(p.processors, reg.processor)
+	}
+	return p, nil
+}
+
+// Pipeline applies a chain of processors
+type Pipeline struct {
+	names      []string
+	labels     []string
+	processors []Processor
+}
+
+// Name returns the normalized spec of the pipeline, e.g. reverse|upper
+func (p *Pipeline) Name() string {
+	return strings.Join(p.names, pipelineSeparator)
+}
+
+// Label describes what the pipeline did, e.g. Reversed, Uppercased
+func (p *Pipeline) Label() string {
+	return strings.Join(p.labels, ", ")
+}
+
+// Process passes the data through each processor in order
+func (p *Pipeline) Process(data []byte) ([]byte, error) {
+	return p.ProcessLimited(data, 0)
+}
+
+// ProcessLimited passes the data through each processor in order and fails
+// as soon as the output of a processor is larger than maxSize bytes, unless
+// maxSize is 0
+func (p *Pipeline) ProcessLimited(data []byte, maxSize int) ([]byte, error) {
+	var err error
+	for i, proc := range p.processors {
+		if data, err = proc.Process(data); err != nil {
+			return nil, errors.Wrapf(err, "error processing data with %s", p.names[i])
+		}
+		if maxSize > 0 && len(data) > maxSize {
+			return nil, errors.Errorf("%s output is larger than %d bytes", p.names[i], maxSize)
+		}
+	}
+	return data, nil
+}
+
+var builtins = []struct {
+	name      string
+	label     string
+	processor ProcessorFunc
+}{
+	{"reverse", "Reversed", func(data []byte) ([]byte, error) {
+		return []byte(ReverseString(string(data))), nil
+	}},
+	{"reverse-graphemes", "Reversed", func(data []byte) ([]byte, error) {
+		return []byte(ReverseGraphemes(string(data))), nil
+	}},
+	{"upper", "Uppercased", func(data []byte) ([]byte, error) {
+		return bytes.ToUpper(data), nil
+	}},
+	{"base64-encode", "Base64 encoded", func(data []byte) ([]byte, error) {
+		out := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
+		base64.StdEncoding.Encode(out, data)
+		return out, nil
+	}},
+	{"base64-decode", "Base64 decoded", func(data []byte) ([]byte, error) {
+		out := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+		n, err := base64.StdEncoding.Decode(out, data)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid base64 data")
+		}
+		return out[:n], nil
+	}},
+	{"sha256", "SHA256 hashed", func(data []byte) ([]byte, error) {
+		sum := sha256.Sum256(data)
+		return []byte(hex.EncodeToString(sum[:])), nil
+	}},
+	{"json", "JSON formatted", func(data []byte) ([]byte, error) {
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, data, "", "  "); err != nil {
+			return nil, errors.Wrap(err, "invalid JSON data")
+		}
+		return buf.Bytes(), nil
+	}},
+	{"echo", "Echoed", func(data []byte) ([]byte, error) {
+		return data, nil
+	}},
+}
@@ -0,0 +1,108 @@
+package format
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipeline(t *testing.T) {
+	r := NewRegistry()
+	tests := []struct {
+		name  string
+		spec  string
+		in    string
+		out   string
+		label string
+		err   bool
+	}{
+		{name: "default", spec: "", in: "test", out: "tset", label: "Reversed"},
+		{name: "reverse", spec: "reverse", in: "héllo", out: "olléh", label: "Reversed"},
+		{name: "graphemes", spec: "reverse-graphemes", in: "he\u0301llo", out: "olle\u0301h", label: "Reversed"},
+		{name: "upper", spec: "upper", in: "test", out: "TEST", label: "Uppercased"},
+		{name: "encode", spec: "base64-encode", in: "test", out: "dGVzdA==", label: "Base64 encoded"},
+		{name: "decode", spec: "base64-decode", in: "dGVzdA==", out: "test", label: "Base64 decoded"},
+		{name: "invalid base64", spec: "base64-decode", in: "!", err: true},
+		{name: "sha256", spec: "sha256", in: "test",
+			out: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", label: "SHA256 hashed"},
+		{name: "json", spec: "json", in: `{"a":1}`, out: "{\n  \"a\": 1\n}", label: "JSON formatted"},
+		{name: "invalid json", spec: "json", in: "{", err: true},
+		{name: "echo", spec: "echo", in: "test", out: "test", label: "Echoed"},
+		{name: "chain", spec: "reverse|upper", in: "test", out: "TSET", label: "Reversed, Uppercased"},
+		{name: "round trip", spec: " base64-encode | base64-decode ", in: "test", out: "test",
+			label: "Base64 encoded, Base64 decoded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := r.Pipeline(tt.spec)
+			require.NoError(t, err)
+			out, err := p.Process([]byte(tt.in))
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.out, string(out))
+			assert.Equal(t, tt.label, p.Label())
+		})
+	}
+
+	t.Run("name", func(t *testing.T) {
+		p, err := r.Pipeline(" reverse | upper")
+		require.NoError(t, err)
+		assert.Equal(t, "reverse|upper", p.Name())
+	})
+
+	t.Run("max stages", func(t *testing.T) {
+		spec := strings.Repeat("echo|", MaxPipelineStages-1) + "echo"
+		_, err := r.Pipeline(spec)
+		require.NoError(t, err)
+		_, err = r.Pipeline(spec + "|echo")
+		assert.Error(t, err)
+	})
+
+	t.Run("max size", func(t *testing.T) {
+		p, err := r.Pipeline("base64-encode|base64-encode")
+		require.NoError(t, err)
+		// test is encoded to 8 bytes and then to 12 bytes
+		out, err := p.ProcessLimited([]byte("test"), 12)
+		require.NoError(t, err)
+		assert.Equal(t, "ZEdWemRBPT0=", string(out))
+		_, err = p.ProcessLimited([]byte("test"), 11)
+		assert.Error(t, err)
+		_, err = p.ProcessLimited([]byte("test"), 7)
+		assert.Error(t, err)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		for _, spec := range []string{"nope", "reverse|nope", "reverse|"} {
+			_, err := r.Pipeline(spec)
+			assert.Error(t, err, spec)
+		}
+	})
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	assert.Equal(t, []string{"base64-decode", "base64-encode", "echo", "json", "reverse", "reverse-graphemes", "sha256", "upper"}, r.Names())
+
+	lower := ProcessorFunc(func(data []byte) ([]byte, error) {
+		return bytes.ToLower(data), nil
+	})
+	require.NoError(t, r.Register("lower", "Lowercased", lower))
+	assert.Error(t, r.Register("lower", "", lower), "names are unique")
+	assert.Error(t, r.Register("a|b", "", lower))
+	assert.Error(t, r.Register("", "", lower))
+	assert.Error(t, r.Register("nil", "", nil))
+
+	p, err := r.Pipeline("upper|lower")
+	require.NoError(t, err)
+	out, err := p.Process([]byte("Test"))
+	require.NoError(t, err)
+	assert.Equal(t, "test", string(out))
+
+	assert.NotContains(t, NewRegistry().Names(), "lower", "registries are independent")
+}
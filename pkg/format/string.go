@@ -1,5 +1,11 @@
 package format
 
+import (
+	"strings"
+
+	"github.com/rivo/uniseg"
+)
+
 // ReverseString reverses the passed string
 func ReverseString(s string) string {
 	runes := []rune(s)
@@ -8,3 +14,23 @@ func ReverseString(s string) string {
 	}
 	return string(runes)
 }
+
+// ReverseGraphemes reverses the passed string by its extended grapheme
+// clusters (UAX #29) so user-perceived characters like flags, emoji ZWJ
+// sequences, skin-tone modifiers, and combining accents are kept intact.
+// Clusters which only exist due to their neighbors, like a leading combining
+// mark or an unpaired regional indicator, may regroup once reversed.
+func ReverseGraphemes(s string) string {
+	clusters := make([]string, 0, len(s))
+	g := uniseg.NewGraphemes(s)
+	for g.Next() {
+		clusters = append(clusters, g.Str())
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := len(clusters) - 1; i >= 0; i-- {
+		b.WriteString(clusters[i])
+	}
+	return b.String()
+}
@@ -2,7 +2,9 @@ package format
 
 import (
 	"testing"
+	"unicode/utf8"
 
+	"github.com/rivo/uniseg"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -14,3 +16,81 @@ func TestStringReversal(t *testing.T) {
 		assert.Equal(t, "tset", v)
 	})
 }
+
+func TestGraphemeReversal(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    string
+		runes string
+		out   string
+	}{
+		{name: "empty", in: "", runes: "", out: ""},
+		{name: "ascii", in: "test", runes: "tset", out: "tset"},
+		{name: "precomposed accent", in: "café", runes: "éfac", out: "éfac"},
+		{name: "combining accent", in: "café", runes: "́efac", out: "éfac"},
+		{name: "multiple combining marks", in: "aẹ́b", runes: "ḅ́ea", out: "bẹ́a"},
+		{name: "skin tone", in: "a\U0001F44D\U0001F3FDb", runes: "b\U0001F3FD\U0001F44Da", out: "b\U0001F44D\U0001F3FDa"},
+		{name: "flags", in: "\U0001F1FA\U0001F1F8\U0001F1EF\U0001F1F5",
+			runes: "\U0001F1F5\U0001F1EF\U0001F1F8\U0001F1FA", out: "\U0001F1EF\U0001F1F5\U0001F1FA\U0001F1F8"},
+		{name: "zwj family", in: "x\U0001F468‍\U0001F469‍\U0001F467y",
+			runes: "y\U0001F467‍\U0001F469‍\U0001F468x", out: "y\U0001F468‍\U0001F469‍\U0001F467x"},
+		{name: "hangul jamo", in: "\u1100\u1161\u11A8a", runes: "a\u11A8\u1161\u1100", out: "a\u1100\u1161\u11A8"},
+		{name: "crlf", in: "a\r\nb", runes: "b\n\ra", out: "b\r\na"},
+		{name: "keycap", in: "1️⃣2", runes: "2⃣️1", out: "21️⃣"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.runes, ReverseString(tt.in), "rune mode")
+			assert.Equal(t, tt.out, ReverseGraphemes(tt.in), "grapheme mode")
+			assert.Equal(t, tt.in, ReverseGraphemes(ReverseGraphemes(tt.in)))
+		})
+	}
+}
+
+func FuzzReverseString(f *testing.F) {
+	for _, s := range []string{"test", "café", "\U0001F1FA\U0001F1F8", "a\r\nb"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		if !utf8.ValidString(s) {
+			t.Skip("invalid UTF-8 is replaced when reversing runes")
+		}
+		v := ReverseString(s)
+		assert.Equal(t, utf8.RuneCountInString(s), utf8.RuneCountInString(v))
+		assert.Equal(t, s, ReverseString(v))
+	})
+}
+
+func FuzzReverseGraphemes(f *testing.F) {
+	for _, s := range []string{"test", "café", "\U0001F1FA\U0001F1F8", "a\U0001F44D\U0001F3FDb",
+		"\U0001F468‍\U0001F469‍\U0001F467", "́a", "\U0001F1FA\U0001F1F8\U0001F1EF"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		if !utf8.ValidString(s) {
+			t.Skip("invalid UTF-8 is replaced when segmenting")
+		}
+		v := ReverseGraphemes(s)
+		assert.Equal(t, len(s), len(v))
+		if !sameClusters(s, v) {
+			// clusters regrouped by their new neighbors are not reversed back
+			return
+		}
+		assert.Equal(t, s, ReverseGraphemes(v))
+	})
+}
+
+// sameClusters reports whether the reversed string keeps the clusters of s
+func sameClusters(s, reversed string) bool {
+	list := make([]string, 0)
+	for g := uniseg.NewGraphemes(s); g.Next(); {
+		list = append(list, g.Str())
+	}
+	i := len(list) - 1
+	for g := uniseg.NewGraphemes(reversed); g.Next(); i-- {
+		if i < 0 || list[i] != g.Str() {
+			return false
+		}
+	}
+	return i == -1
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// DefaultDedupWindow is the default time processed content IDs are remembered
+	DefaultDedupWindow = time.Minute
+	// DefaultDedupMaxEntries is the default max number of remembered content IDs
+	DefaultDedupMaxEntries = 10000
+)
+
+// dedupKey identifies a message by its content ID within the client which
+// sent it, so clients never get the responses of the other clients
+type dedupKey struct {
+	clientID string
+	id       string
+}
+
+// dedupEntry holds the response of a processed content ID. Until done is
+// closed the message is still being processed.
+type dedupEntry struct {
+	key     dedupKey
+	expires time.Time
+	done    chan struct{}
+	res     *pb.PingResponse
+	err     error
+}
+
+// dedupCache remembers the responses of the content IDs processed within the
+// window, up to the max number of entries, so duplicates are not processed
+// again. Entries expire in the order they were added as the window is the
+// same for all of them, and the oldest ones are evicted first when full.
+type dedupCache struct {
+	window     time.Duration
+	maxEntries int
+	lock       sync.Mutex
+	entries    map[dedupKey]*list.Element
+	order      *list.List
+}
+
+func newDedupCache(window time.Duration, maxEntries int) *dedupCache {
+	return &dedupCache{
+		window:     window,
+		maxEntries: maxEntries,
+		entries:    make(map[dedupKey]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// do returns the response of the content ID if it was processed within the
+// window, waiting for it, or until ctx is done, if the ID is being processed
+// concurrently. Otherwise it calls process and remembers its response. Failed
+// responses, including the ones of a panicking process, are not remembered so
+// a retry is processed again. The returned bool reports whether the response
+// came from the cache.
+func (c *dedupCache) do(ctx context.Context, key dedupKey, process func() (*pb.PingResponse, error)) (*pb.PingResponse, error, bool) {
+	if c.window <= 0 || key.id == "" {
+		res, err := process()
+		return res, err, false
+	}
+
+	now := time.Now()
+	c.lock.Lock()
+	c.evict(now)
+	if el, ok := c.entries[key]; ok {
+		c.lock.Unlock()
+		e := el.Value.(*dedupEntry)
+		select {
+		case <-e.done:
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err(), true
+		}
+		if e.res == nil {
+			return nil, e.err, true
+		}
+		return proto.Clone(e.res).(*pb.PingResponse), e.err, true
+	}
+	e := &dedupEntry{key: key, expires: now.Add(c.window), done: make(chan struct{})}
+	c.entries[key] = c.order.PushBack(e)
+	c.lock.Unlock()
+
+	completed := false
+	defer func() {
+		if !completed {
+			e.err = status.Error(codes.Internal, "error processing the original message")
+		}
+		if e.err != nil {
+			c.remove(e)
+		}
+		close(e.done)
+	}()
+	e.res, e.err = process()
+	completed = true
+	return e.res, e.err, false
+}
+
+// evict removes the expired entries, and the oldest ones while the cache is
+// full, callers must hold the lock
+func (c *dedupCache) evict(now time.Time) {
+	for el := c.order.Front(); el != nil; el = c.order.Front() {
+		e := el.Value.(*dedupEntry)
+		if now.Before(e.expires) && (c.maxEntries <= 0 || c.order.Len() < c.maxEntries) {
+			return
+		}
+		c.order.Remove(el)
+		delete(c.entries, e.key)
+	}
+}
+
+func (c *dedupCache) remove(e *dedupEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if el, ok := c.entries[e.key]; ok && el.Value == e {
+		c.order.Remove(el)
+		delete(c.entries, e.key)
+	}
+}
+
+// enabled reports whether content IDs are remembered at all
+func (c *dedupCache) enabled() bool {
+	return c.window > 0
+}
+
+// size returns the number of remembered content IDs
+func (c *dedupCache) size() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.entries)
+}
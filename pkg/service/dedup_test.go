@@ -0,0 +1,285 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"github.com/mchmarny/grpc-lab/pkg/format"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func testKey(id string) dedupKey {
+	return dedupKey{clientID: "test", id: id}
+}
+
+func TestDedupCache(t *testing.T) {
+	ctx := context.Background()
+	var calls int32
+	process := func() (*pb.PingResponse, error) {
+		n := atomic.AddInt32(&calls, 1)
+		return &pb.PingResponse{MessageCount: int64(n)}, nil
+	}
+
+	t.Run("duplicate", func(t *testing.T) {
+		atomic.StoreInt32(&calls, 0)
+		c := newDedupCache(time.Minute, 0)
+		res1, err, dup := c.do(ctx, testKey("id1"), process)
+		require.NoError(t, err)
+		assert.False(t, dup)
+
+		res2, err, dup := c.do(ctx, testKey("id1"), process)
+		require.NoError(t, err)
+		assert.True(t, dup)
+		assert.Equal(t, res1.MessageCount, res2.MessageCount)
+		assert.NotSame(t, res1, res2, "duplicates get a copy of the response")
+
+		_, _, dup = c.do(ctx, testKey("id2"), process)
+		assert.False(t, dup)
+		assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		atomic.StoreInt32(&calls, 0)
+		c := newDedupCache(20*time.Millisecond, 0)
+		_, _, dup := c.do(ctx, testKey("id1"), process)
+		assert.False(t, dup)
+		time.Sleep(30 * time.Millisecond)
+
+		res, _, dup := c.do(ctx, testKey("id1"), process)
+		assert.False(t, dup)
+		assert.Equal(t, int64(2), res.MessageCount)
+		assert.Equal(t, 1, c.size(), "expired entries are evicted")
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		c := newDedupCache(time.Minute, 0)
+		fail := func() (*pb.PingResponse, error) {
+			return &pb.PingResponse{}, status.Error(codes.Internal, "test")
+		}
+		_, err, _ := c.do(ctx, testKey("id1"), fail)
+		require.Error(t, err)
+		assert.Equal(t, 0, c.size(), "failed responses are not remembered")
+
+		_, err, dup := c.do(ctx, testKey("id1"), process)
+		require.NoError(t, err)
+		assert.False(t, dup)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		c := newDedupCache(0, 0)
+		assert.False(t, c.enabled())
+		c.do(ctx, testKey("id1"), process)
+		_, _, dup := c.do(ctx, testKey("id1"), process)
+		assert.False(t, dup)
+		assert.Equal(t, 0, c.size())
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		atomic.StoreInt32(&calls, 0)
+		c := newDedupCache(time.Minute, 0)
+		release := make(chan struct{})
+		slow := func() (*pb.PingResponse, error) {
+			<-release
+			return process()
+		}
+
+		const n = 10
+		var wg sync.WaitGroup
+		var dups int32
+		results := make([]*pb.PingResponse, n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				res, err, dup := c.do(ctx, testKey("id1"), slow)
+				assert.NoError(t, err)
+				if dup {
+					atomic.AddInt32(&dups, 1)
+				}
+				results[i] = res
+			}(i)
+		}
+		close(release)
+		wg.Wait()
+
+		assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+		assert.Equal(t, int32(n-1), atomic.LoadInt32(&dups))
+		for _, res := range results {
+			assert.Equal(t, int64(1), res.MessageCount)
+		}
+	})
+
+	t.Run("clients", func(t *testing.T) {
+		atomic.StoreInt32(&calls, 0)
+		c := newDedupCache(time.Minute, 0)
+		_, _, dup := c.do(ctx, dedupKey{clientID: "a", id: "id1"}, process)
+		assert.False(t, dup)
+		res, _, dup := c.do(ctx, dedupKey{clientID: "b", id: "id1"}, process)
+		assert.False(t, dup, "clients never get the responses of the other clients")
+		assert.Equal(t, int64(2), res.MessageCount)
+	})
+
+	t.Run("max entries", func(t *testing.T) {
+		c := newDedupCache(time.Minute, 2)
+		for _, id := range []string{"id1", "id2", "id3"} {
+			c.do(ctx, testKey(id), process)
+		}
+		assert.Equal(t, 2, c.size())
+		_, _, dup := c.do(ctx, testKey("id3"), process)
+		assert.True(t, dup)
+		_, _, dup = c.do(ctx, testKey("id1"), process)
+		assert.False(t, dup, "the oldest entries are evicted first")
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		c := newDedupCache(time.Minute, 0)
+		release := make(chan struct{})
+		go func() {
+			defer func() { _ = recover() }()
+			c.do(ctx, testKey("id1"), func() (*pb.PingResponse, error) {
+				<-release
+				panic("test")
+			})
+		}()
+		require.Eventually(t, func() bool { return c.size() == 1 }, time.Second, time.Millisecond)
+
+		errCh := make(chan error, 1)
+		go func() {
+			_, err, _ := c.do(ctx, testKey("id1"), process)
+			errCh <- err
+		}()
+		// let the duplicate wait for the original message
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+		select {
+		case err := <-errCh:
+			assert.Equal(t, codes.Internal, status.Code(err))
+		case <-time.After(time.Second):
+			t.Fatal("duplicate of a panicked message is blocked")
+		}
+		assert.Equal(t, 0, c.size(), "panicked messages are not remembered")
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		c := newDedupCache(time.Minute, 0)
+		release := make(chan struct{})
+		defer close(release)
+		go c.do(ctx, testKey("id1"), func() (*pb.PingResponse, error) {
+			<-release
+			return process()
+		})
+		require.Eventually(t, func() bool { return c.size() == 1 }, time.Second, time.Millisecond)
+
+		cctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+		_, err, dup := c.do(cctx, testKey("id1"), process)
+		assert.True(t, dup)
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	})
+}
+
+func TestStreamConcurrentDuplicates(t *testing.T) {
+	lis := startBufconnServer(t)
+	c := pb.NewServiceClient(dialConn(t, lis))
+	ctx := context.Background()
+
+	// the same messages sent concurrently over several streams
+	reqs := []*pb.PingRequest{getTestRequest(), getTestRequest(), getTestRequest()}
+	const streams = 5
+	responses := make([][]*pb.PingResponse, streams)
+	var wg sync.WaitGroup
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stream, err := c.Stream(ctx)
+			if !assert.NoError(t, err) {
+				return
+			}
+			for _, req := range reqs {
+				if !assert.NoError(t, stream.Send(req)) {
+					return
+				}
+				res, err := stream.Recv()
+				if !assert.NoError(t, err) {
+					return
+				}
+				responses[i] = append(responses[i], res)
+			}
+			assert.NoError(t, stream.CloseSend())
+		}(i)
+	}
+	wg.Wait()
+	for _, list := range responses {
+		require.Len(t, list, len(reqs))
+	}
+
+	for i := 1; i < streams; i++ {
+		for j := range reqs {
+			assert.Equal(t, responses[0][j].MessageID, responses[i][j].MessageID)
+			assert.Equal(t, responses[0][j].MessageCount, responses[i][j].MessageCount)
+			assert.Equal(t, responses[0][j].Processed, responses[i][j].Processed, "duplicates get the original response")
+		}
+	}
+
+	stats, err := c.GetStats(ctx, &pb.GetStatsRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(reqs)), stats.MessageCount, "each message is processed once")
+}
+
+func TestDedupMetrics(t *testing.T) {
+	srv := NewPingService(nil)
+	ctx := context.Background()
+	req := getTestRequest()
+	for i := 0; i < 3; i++ {
+		_, err := srv.processReq(ctx, pingMethodName, req)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, float64(1), testutil.ToFloat64(srv.metrics.dedupLookups.WithLabelValues("miss")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(srv.metrics.dedupLookups.WithLabelValues("hit")))
+
+	srv = NewPingService(nil, WithDedupWindow(0))
+	for i := 0; i < 2; i++ {
+		res, err := srv.processReq(ctx, pingMethodName, req)
+		require.NoError(t, err)
+		assert.Equal(t, int64(i+1), res.MessageCount, "duplicates are processed when disabled")
+	}
+	assert.Equal(t, 0, testutil.CollectAndCount(srv.metrics.dedupLookups))
+}
+
+func TestDedupNoResponse(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	r := format.NewRegistry()
+	require.NoError(t, r.Register("block", "Blocked", format.ProcessorFunc(func(data []byte) ([]byte, error) {
+		<-release
+		return data, nil
+	})))
+	srv := NewPingService(nil, WithProcessors(r))
+	req := getTestRequest()
+	req.Content.Metadata[ProcessorKey] = "block"
+	go func() { _, _ = srv.processReq(context.Background(), streamMethodName, req) }()
+	require.Eventually(t, func() bool { return srv.dedup.size() == 1 }, time.Second, time.Millisecond)
+
+	// the duplicate gives up waiting for the original message
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	res, duplicate, err := srv.processMessage(ctx, streamMethodName, req, nil)
+	assert.True(t, duplicate)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	require.NotNil(t, res, "streams get a response to correlate")
+	assert.Equal(t, req.Content.Id, res.MessageID)
+	assert.Equal(t, pb.PingResponse_Error, res.Result)
+	assert.NotEmpty(t, res.ErrorMessage)
+
+	assert.Equal(t, float64(0), testutil.ToFloat64(srv.metrics.dedupLookups.WithLabelValues("hit")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(srv.metrics.dedupLookups.WithLabelValues("miss")), "the original is still processing")
+}
@@ -0,0 +1,320 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// FaultDelayKey is the metadata key of the delay injected into the call, e.g. 100ms
+	FaultDelayKey = "fault-delay"
+	// FaultCodeKey is the metadata key of the code the call fails with, e.g. UNAVAILABLE
+	FaultCodeKey = "fault-code"
+	// FaultPercentKey is the metadata key of the chance (0-100) the call fails
+	FaultPercentKey = "fault-percent"
+	// FaultAbortAfterKey is the metadata key of the number of messages sent before the stream is aborted
+	FaultAbortAfterKey = "fault-abort-after"
+	// FaultHangKey is the metadata key making the call hang until its deadline when true
+	FaultHangKey = "fault-hang"
+
+	serviceMethodPrefix = "/io.thingz.grpc.v1.Service/"
+)
+
+// Faults configures the faults injected into the service calls
+type Faults struct {
+	// Delay delays each call before it is handled
+	Delay time.Duration
+	// Code fails the calls with the code, unless OK
+	Code codes.Code
+	// Percent fails the percentage of the calls, all of them when 0. Calls fail
+	// with Unavailable unless Code is set.
+	Percent int
+	// AbortAfter aborts the streams once they sent this number of messages, unless 0
+	AbortAfter int
+	// Hang blocks the calls until they are canceled or their deadline passes
+	Hang bool
+}
+
+// failing reports whether the faults fail the calls
+func (f Faults) failing() bool {
+	return f.Code != codes.OK || f.Percent > 0
+}
+
+// failCode returns the code the calls fail with
+func (f Faults) failCode() codes.Code {
+	if f.Code == codes.OK {
+		return codes.Unavailable
+	}
+	return f.Code
+}
+
+func (f Faults) validate() []*errdetails.BadRequest_FieldViolation {
+	list := make([]*errdetails.BadRequest_FieldViolation, 0)
+	if f.Delay < 0 {
+		list = append(list, violation("delay", "must not be negative"))
+	}
+	if f.Percent < 0 || f.Percent > 100 {
+		list = append(list, violation("percent", "must be between 0 and 100"))
+	}
+	if f.AbortAfter < 0 {
+		list = append(list, violation("abortAfter", "must not be negative"))
+	}
+	return list
+}
+
+// faultInjector injects the global faults, overridden per call by the call
+// metadata, into the calls of the service methods. When disabled, no faults
+// are injected and the fault metadata is ignored.
+type faultInjector struct {
+	enabled bool
+	lock    sync.RWMutex
+	faults  Faults
+	metrics *serverMetrics
+	// chance returns a number in [0, 100) the percentage is compared against
+	chance func() int
+}
+
+func newFaultInjector(enabled bool, f Faults, m *serverMetrics) *faultInjector {
+	if !enabled {
+		f = Faults{}
+	}
+	return &faultInjector{
+		enabled: enabled,
+		faults:  f,
+		metrics: m,
+		chance:  func() int { return rand.Intn(100) }, //nolint:gosec // no need for secure randomness
+	}
+}
+
+func (fi *faultInjector) get() Faults {
+	fi.lock.RLock()
+	defer fi.lock.RUnlock()
+	return fi.faults
+}
+
+func (fi *faultInjector) set(f Faults) {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	fi.faults = f
+}
+
+// injects reports whether faults are injected into the method, which excludes
+// the fault admin methods so faults can always be turned off
+func injects(method string) bool {
+	switch method {
+	case serviceMethodPrefix + "GetFaults", serviceMethodPrefix + "SetFaults":
+		return false
+	}
+	return strings.HasPrefix(method, serviceMethodPrefix)
+}
+
+// callFaults returns the global faults overridden by the call metadata
+func (fi *faultInjector) callFaults(ctx context.Context) (Faults, error) {
+	f := fi.get()
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return f, nil
+	}
+
+	list := make([]*errdetails.BadRequest_FieldViolation, 0)
+	value := func(key string, parse func(string) error) {
+		v := md.Get(key)
+		if len(v) == 0 {
+			return
+		}
+		if err := parse(strings.TrimSpace(v[0])); err != nil {
+			list = append(list, violation(fmt.Sprintf("metadata[%s]", key), err.Error()))
+		}
+	}
+	value(FaultDelayKey, func(v string) (err error) {
+		f.Delay, err = time.ParseDuration(v)
+		return errors.Wrap(err, "is not a duration")
+	})
+	value(FaultCodeKey, func(v string) (err error) {
+		f.Code, err = ParseCode(v)
+		return err
+	})
+	value(FaultPercentKey, func(v string) (err error) {
+		f.Percent, err = strconv.Atoi(v)
+		return errors.Wrap(err, "is not a number")
+	})
+	value(FaultAbortAfterKey, func(v string) (err error) {
+		f.AbortAfter, err = strconv.Atoi(v)
+		return errors.Wrap(err, "is not a number")
+	})
+	value(FaultHangKey, func(v string) (err error) {
+		f.Hang, err = strconv.ParseBool(v)
+		return errors.Wrap(err, "is not a bool")
+	})
+	if len(list) == 0 {
+		list = f.validate()
+	}
+	if len(list) > 0 {
+		return f, invalidArgument(list)
+	}
+	return f, nil
+}
+
+// inject delays, hangs, or fails the call as configured
+func (fi *faultInjector) inject(ctx context.Context, method string, f Faults) error {
+	if f.Delay > 0 {
+		fi.metrics.faults.WithLabelValues(method, "delay").Inc()
+		select {
+		case <-time.After(f.Delay):
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+	if f.Hang {
+		fi.metrics.faults.WithLabelValues(method, "hang").Inc()
+		<-ctx.Done()
+		return status.FromContextError(ctx.Err()).Err()
+	}
+	if f.failing() && (f.Percent == 0 || fi.chance() < f.Percent) {
+		fi.metrics.faults.WithLabelValues(method, "error").Inc()
+		return status.Errorf(f.failCode(), "injected fault: %s", method)
+	}
+	return nil
+}
+
+func (fi *faultInjector) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !fi.enabled || !injects(info.FullMethod) {
+		return handler(ctx, req)
+	}
+	f, err := fi.callFaults(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := fi.inject(ctx, info.FullMethod, f); err != nil {
+		log.WithError(err).Debug("injected fault")
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (fi *faultInjector) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !fi.enabled || !injects(info.FullMethod) {
+		return handler(srv, ss)
+	}
+	f, err := fi.callFaults(ss.Context())
+	if err != nil {
+		return err
+	}
+	if err := fi.inject(ss.Context(), info.FullMethod, f); err != nil {
+		log.WithError(err).Debug("injected fault")
+		return err
+	}
+	if f.AbortAfter == 0 {
+		return handler(srv, ss)
+	}
+
+	as := &abortingStream{ServerStream: ss, remaining: f.AbortAfter}
+	err = handler(srv, as)
+	if as.aborted {
+		fi.metrics.faults.WithLabelValues(info.FullMethod, "abort").Inc()
+		return status.Errorf(codes.Aborted, "injected fault: stream aborted after %d messages", f.AbortAfter)
+	}
+	return err
+}
+
+// abortingStream fails sending once the number of messages were sent. Sends
+// are never concurrent so the fields are only accessed by the sending goroutine.
+type abortingStream struct {
+	grpc.ServerStream
+	remaining int
+	aborted   bool
+}
+
+func (s *abortingStream) SendMsg(m interface{}) error {
+	if s.remaining == 0 {
+		s.aborted = true
+		return status.Error(codes.Aborted, "injected fault: stream aborted")
+	}
+	s.remaining--
+	return s.ServerStream.SendMsg(m)
+}
+
+// ParseCode parses the gRPC code from its number or name, e.g. 14,
+// UNAVAILABLE, or Unavailable
+func ParseCode(v string) (codes.Code, error) {
+	if n, err := strconv.ParseUint(v, 10, 32); err == nil {
+		if n > uint64(codes.Unauthenticated) {
+			return codes.OK, errors.Errorf("is not a valid code: %s", v)
+		}
+		return codes.Code(n), nil
+	}
+	name := strings.ReplaceAll(v, "_", "")
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		if strings.EqualFold(c.String(), name) {
+			return c, nil
+		}
+	}
+	return codes.OK, errors.Errorf("is not a valid code: %s", v)
+}
+
+// GetFaults returns the faults injected into all the calls
+func (s *PingService) GetFaults(ctx context.Context, req *pb.GetFaultsRequest) (*pb.Faults, error) {
+	return faultsToProto(s.faults.get()), nil
+}
+
+// SetFaults replaces the faults injected into all the calls. It's denied
+// unless fault injection is enabled.
+func (s *PingService) SetFaults(ctx context.Context, req *pb.Faults) (*pb.Faults, error) {
+	if !s.faults.enabled {
+		return nil, status.Error(codes.PermissionDenied, "fault injection is disabled")
+	}
+	f := Faults{
+		Delay:      time.Duration(req.GetDelayMs()) * time.Millisecond,
+		Percent:    int(req.GetPercent()),
+		AbortAfter: int(req.GetAbortAfter()),
+		Hang:       req.GetHang(),
+	}
+	list := f.validate()
+	if req.GetCode() != "" {
+		c, err := ParseCode(req.GetCode())
+		if err != nil {
+			list = append(list, violation("code", err.Error()))
+		}
+		f.Code = c
+	}
+	if len(list) > 0 {
+		return nil, invalidArgument(list)
+	}
+
+	s.faults.set(f)
+	log.WithFields(log.Fields{
+		"delay":       f.Delay.String(),
+		"code":        f.Code.String(),
+		"percent":     f.Percent,
+		"abort_after": f.AbortAfter,
+		"hang":        f.Hang,
+	}).Warn("faults updated")
+	return faultsToProto(f), nil
+}
+
+func faultsToProto(f Faults) *pb.Faults {
+	res := &pb.Faults{
+		DelayMs:    f.Delay.Milliseconds(),
+		Percent:    int32(f.Percent),
+		AbortAfter: int32(f.AbortAfter),
+		Hang:       f.Hang,
+	}
+	if f.Code != codes.OK {
+		res.Code = f.Code.String()
+	}
+	return res
+}
@@ -0,0 +1,221 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestCallFaults(t *testing.T) {
+	lis := startBufconnServer(t, WithFaultInjection(true))
+	c := pb.NewServiceClient(dialConn(t, lis))
+
+	ping := func(ctx context.Context, kv ...string) error {
+		_, err := c.Ping(metadata.AppendToOutgoingContext(ctx, kv...), getTestRequest())
+		return err
+	}
+
+	t.Run("none", func(t *testing.T) {
+		assert.NoError(t, ping(context.Background()))
+	})
+
+	t.Run("code", func(t *testing.T) {
+		for _, v := range []string{"UNAVAILABLE", "Unavailable", "14"} {
+			err := ping(context.Background(), FaultCodeKey, v)
+			assert.Equal(t, codes.Unavailable, status.Code(err), v)
+		}
+		err := ping(context.Background(), FaultCodeKey, "RESOURCE_EXHAUSTED")
+		assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	})
+
+	t.Run("percent", func(t *testing.T) {
+		err := ping(context.Background(), FaultPercentKey, "100")
+		assert.Equal(t, codes.Unavailable, status.Code(err), "calls fail with Unavailable by default")
+		assert.NoError(t, ping(context.Background(), FaultPercentKey, "0"))
+	})
+
+	t.Run("delay", func(t *testing.T) {
+		start := time.Now()
+		require.NoError(t, ping(context.Background(), FaultDelayKey, "50ms"))
+		assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		err := ping(ctx, FaultDelayKey, "1s")
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	})
+
+	t.Run("hang", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		err := ping(ctx, FaultHangKey, "true")
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+		assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		err := ping(context.Background(),
+			FaultDelayKey, "soon",
+			FaultCodeKey, "NOPE",
+			FaultPercentKey, "x",
+			FaultAbortAfterKey, "x",
+			FaultHangKey, "maybe",
+		)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		assert.ElementsMatch(t, []string{
+			"metadata[fault-delay]", "metadata[fault-code]", "metadata[fault-percent]",
+			"metadata[fault-abort-after]", "metadata[fault-hang]",
+		}, violationFields(t, err))
+
+		err = ping(context.Background(), FaultPercentKey, "101", FaultAbortAfterKey, "-1")
+		assert.ElementsMatch(t, []string{"percent", "abortAfter"}, violationFields(t, err))
+	})
+}
+
+func TestFaultPercent(t *testing.T) {
+	lis := bufconn.Listen(1024 * 1024)
+	srv := NewPingService(lis, WithFaultInjection(true), WithFaults(Faults{Code: codes.Internal, Percent: 30}))
+	var n int
+	srv.faults.chance = func() int {
+		n++
+		return (n - 1) * 10 % 100
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { _ = srv.Start(ctx) }()
+	t.Cleanup(cancel)
+	c := pb.NewServiceClient(dialConn(t, lis))
+
+	var failed int
+	for i := 0; i < 10; i++ {
+		if _, err := c.Ping(ctx, getTestRequest()); err != nil {
+			assert.Equal(t, codes.Internal, status.Code(err))
+			failed++
+		}
+	}
+	assert.Equal(t, 3, failed)
+	assert.Equal(t, float64(3), testutil.ToFloat64(srv.metrics.faults.WithLabelValues(pingMethod, "error")))
+}
+
+func TestFaultAdmin(t *testing.T) {
+	lis := startBufconnServer(t, WithFaultInjection(true), WithFaults(Faults{Code: codes.Unavailable}))
+	conn := dialConn(t, lis)
+	c := pb.NewServiceClient(conn)
+	ctx := context.Background()
+
+	_, err := c.Ping(ctx, getTestRequest())
+	assert.Equal(t, codes.Unavailable, status.Code(err), "global faults are injected")
+
+	// the admin and health methods are never faulted
+	faults, err := c.GetFaults(ctx, &pb.GetFaultsRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, "Unavailable", faults.Code)
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+
+	faults, err = c.SetFaults(ctx, &pb.Faults{Code: "ABORTED", DelayMs: 10})
+	require.NoError(t, err)
+	assert.True(t, proto.Equal(&pb.Faults{Code: "Aborted", DelayMs: 10}, faults))
+	_, err = c.Ping(ctx, getTestRequest())
+	assert.Equal(t, codes.Aborted, status.Code(err))
+
+	t.Run("override", func(t *testing.T) {
+		_, err := c.Ping(metadata.AppendToOutgoingContext(ctx, FaultCodeKey, "OK"), getTestRequest())
+		assert.NoError(t, err, "call metadata overrides the global faults")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := c.SetFaults(ctx, &pb.Faults{Code: "NOPE", Percent: 200, DelayMs: -1, AbortAfter: -1})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		assert.ElementsMatch(t, []string{"code", "percent", "delay", "abortAfter"}, violationFields(t, err))
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		_, err := c.SetFaults(ctx, &pb.Faults{})
+		require.NoError(t, err)
+		_, err = c.Ping(ctx, getTestRequest())
+		assert.NoError(t, err)
+	})
+}
+
+func TestFaultInjectionDisabled(t *testing.T) {
+	lis := startBufconnServer(t, WithFaults(Faults{Code: codes.Unavailable}))
+	c := pb.NewServiceClient(dialConn(t, lis))
+	ctx := context.Background()
+
+	_, err := c.Ping(ctx, getTestRequest())
+	assert.NoError(t, err, "global faults are ignored")
+	_, err = c.Ping(metadata.AppendToOutgoingContext(ctx, FaultCodeKey, "UNAVAILABLE"), getTestRequest())
+	assert.NoError(t, err, "fault metadata is ignored")
+
+	_, err = c.SetFaults(ctx, &pb.Faults{Code: "UNAVAILABLE"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	faults, err := c.GetFaults(ctx, &pb.GetFaultsRequest{})
+	require.NoError(t, err)
+	assert.True(t, proto.Equal(&pb.Faults{}, faults))
+}
+
+func TestStreamFaults(t *testing.T) {
+	lis := startBufconnServer(t, WithFaultInjection(true))
+	c := pb.NewServiceClient(dialConn(t, lis))
+
+	t.Run("abort", func(t *testing.T) {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), FaultAbortAfterKey, "2")
+		stream, err := c.Stream(ctx)
+		require.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			require.NoError(t, stream.Send(getTestRequest()))
+		}
+		for i := 0; i < 2; i++ {
+			_, err := stream.Recv()
+			require.NoError(t, err)
+		}
+		_, err = stream.Recv()
+		assert.Equal(t, codes.Aborted, status.Code(err))
+	})
+
+	t.Run("abort subscription", func(t *testing.T) {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), FaultAbortAfterKey, "1")
+		stream, err := c.Subscribe(ctx, &pb.SubscribeRequest{})
+		require.NoError(t, err)
+		_, err = stream.Header()
+		require.NoError(t, err)
+
+		for i := 0; i < 2; i++ {
+			_, err := c.Ping(context.Background(), getTestRequest())
+			require.NoError(t, err)
+		}
+		_, err = stream.Recv()
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		assert.Equal(t, codes.Aborted, status.Code(err))
+	})
+
+	t.Run("code", func(t *testing.T) {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), FaultCodeKey, "UNAVAILABLE")
+		stream, err := c.Stream(ctx)
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	})
+
+	t.Run("hang", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		stream, err := c.Stream(metadata.AppendToOutgoingContext(ctx, FaultHangKey, "true"))
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	})
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+var (
+	// ServiceName is the fully qualified name of the ping service used in health checks
+	ServiceName = pb.Service_ServiceDesc.ServiceName
+)
+
+// healthServer is the gRPC health server which ends the watches on shutdown,
+// once they were sent the final status, so they don't block the drain
+type healthServer struct {
+	*health.Server
+	shutdown chan struct{}
+	once     sync.Once
+}
+
+func newHealthServer() *healthServer {
+	return &healthServer{
+		Server:   health.NewServer(),
+		shutdown: make(chan struct{}),
+	}
+}
+
+// Shutdown sets all the statuses to NOT_SERVING and ends the watches
+func (h *healthServer) Shutdown() {
+	h.Server.Shutdown()
+	h.once.Do(func() { close(h.shutdown) })
+}
+
+// Watch streams the status changes until the client cancels or the server
+// shuts down. The watch ends on shutdown only after a status other than
+// SERVING was sent, so the watchers are always told the server is going away.
+func (h *healthServer) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	w := &watchStream{Health_WatchServer: stream, ctx: ctx, sent: make(chan struct{}, 1)}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- h.Server.Watch(req, w)
+	}()
+
+	shutdown := h.shutdown
+	for {
+		select {
+		case err := <-errCh:
+			return err
+		case <-shutdown:
+			shutdown = nil
+		case <-w.sent:
+		}
+		if shutdown == nil && w.final() {
+			cancel()
+			<-errCh
+			return nil
+		}
+	}
+}
+
+// watchStream keeps track of the last status sent to the watcher
+type watchStream struct {
+	healthpb.Health_WatchServer
+	ctx  context.Context
+	sent chan struct{}
+
+	lock   sync.Mutex
+	status *healthpb.HealthCheckResponse_ServingStatus
+}
+
+func (w *watchStream) Context() context.Context {
+	return w.ctx
+}
+
+func (w *watchStream) Send(res *healthpb.HealthCheckResponse) error {
+	if err := w.Health_WatchServer.Send(res); err != nil {
+		return err
+	}
+	w.lock.Lock()
+	status := res.GetStatus()
+	w.status = &status
+	w.lock.Unlock()
+
+	select {
+	case w.sent <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// final returns true once a status other than SERVING was sent
+func (w *watchStream) final() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.status != nil && *w.status != healthpb.HealthCheckResponse_SERVING
+}
+
+// setServingStatus sets the health status of both the server and the ping service
+func (s *PingService) setServingStatus(status healthpb.HealthCheckResponse_ServingStatus) {
+	log.Infof("setting serving status: %s", status)
+	s.health.SetServingStatus("", status)
+	s.health.SetServingStatus(ServiceName, status)
+}
+
+// healthHandler returns HTTP handler reporting the health status of the service.
+// An empty service name reports on the server as a whole.
+func healthHandler(srv healthpb.HealthServer, service string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := healthpb.HealthCheckResponse_SERVICE_UNKNOWN
+		res, err := srv.Check(r.Context(), &healthpb.HealthCheckRequest{Service: service})
+		if err == nil {
+			status = res.Status
+		}
+
+		code := http.StatusOK
+		if status != healthpb.HealthCheckResponse_SERVING {
+			code = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		if err := json.NewEncoder(w).Encode(map[string]string{"status": status.String()}); err != nil {
+			log.Errorf("error encoding health status: %v", err)
+		}
+	}
+}
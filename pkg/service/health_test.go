@@ -0,0 +1,120 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestHealth(t *testing.T) {
+	lis := bufconn.Listen(1024 * 1024)
+	srv := NewPingService(lis)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { _ = srv.Start(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		lis.Close()
+	})
+
+	hc := healthpb.NewHealthClient(dialConn(t, lis))
+
+	t.Run("check service", func(t *testing.T) {
+		require.Eventually(t, func() bool {
+			res, err := hc.Check(ctx, &healthpb.HealthCheckRequest{Service: ServiceName})
+			return err == nil && res.Status == healthpb.HealthCheckResponse_SERVING
+		}, 3*time.Second, 20*time.Millisecond)
+	})
+
+	t.Run("check unknown service", func(t *testing.T) {
+		_, err := hc.Check(ctx, &healthpb.HealthCheckRequest{Service: "unknown"})
+		assert.Error(t, err)
+	})
+
+	t.Run("watch transitions on shutdown", func(t *testing.T) {
+		watchCtx, watchCancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer watchCancel()
+
+		stream, err := hc.Watch(watchCtx, &healthpb.HealthCheckRequest{Service: ServiceName})
+		require.NoError(t, err)
+
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, healthpb.HealthCheckResponse_SERVING, res.Status)
+
+		cancel()
+
+		res, err = stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, res.Status)
+	})
+}
+
+func TestHealthHTTP(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := NewPingService(lis)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { _ = srv.Start(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		lis.Close()
+	})
+
+	httpAddr := freeAddr(t)
+	go func() { _ = srv.StartHTTP(context.Background(), httpAddr) }()
+
+	for _, path := range []string{"/healthz", "/readyz"} {
+		t.Run(path, func(t *testing.T) {
+			require.Eventually(t, func() bool {
+				code, status := getHealth(t, "http://"+httpAddr+path)
+				return code == http.StatusOK && status == "SERVING"
+			}, 3*time.Second, 20*time.Millisecond)
+		})
+	}
+
+	cancel()
+
+	for _, path := range []string{"/healthz", "/readyz"} {
+		t.Run(path+" on shutdown", func(t *testing.T) {
+			require.Eventually(t, func() bool {
+				code, status := getHealth(t, "http://"+httpAddr+path)
+				return code == http.StatusServiceUnavailable && status == "NOT_SERVING"
+			}, 3*time.Second, 20*time.Millisecond)
+		})
+	}
+}
+
+func getHealth(t *testing.T, url string) (int, string) {
+	t.Helper()
+	resp, err := http.Get(url) // #nosec G107 test URL
+	if err != nil {
+		return 0, ""
+	}
+	defer resp.Body.Close()
+
+	var body map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return resp.StatusCode, ""
+	}
+	return resp.StatusCode, body["status"]
+}
+
+func dialConn(t *testing.T, lis *bufconn.Listener) *grpc.ClientConn {
+	t.Helper()
+	dialer := func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	}
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(), grpc.WithContextDialer(dialer))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
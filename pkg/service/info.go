@@ -0,0 +1,78 @@
+package service
+
+import (
+	"context"
+	"os"
+	"time"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"github.com/mchmarny/grpc-lab/pkg/id"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// ServerInstanceKey is the header and trailer key of the server instance ID
+	ServerInstanceKey = "server-instance"
+	// ServerHostnameKey is the header and trailer key of the server hostname
+	ServerHostnameKey = "server-hostname"
+	// ServerVersionKey is the header and trailer key of the server version
+	ServerVersionKey = "server-version"
+	// ServerStartedKey is the header and trailer key of the server start time (RFC3339)
+	ServerStartedKey = "server-started"
+
+	// DefaultVersion is the server version unless set with WithVersion
+	DefaultVersion = "dev"
+)
+
+// newServerInfo identifies this server instance
+func newServerInfo(version string) *pb.ServerInfo {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.WithError(err).Warn("error getting hostname")
+	}
+	return &pb.ServerInfo{
+		InstanceID: id.NewID(),
+		Hostname:   hostname,
+		Version:    version,
+		Started:    time.Now().UTC().UnixNano(),
+	}
+}
+
+// infoMetadata returns the server identity as call metadata
+func infoMetadata(info *pb.ServerInfo) metadata.MD {
+	return metadata.Pairs(
+		ServerInstanceKey, info.GetInstanceID(),
+		ServerHostnameKey, info.GetHostname(),
+		ServerVersionKey, info.GetVersion(),
+		ServerStartedKey, time.Unix(0, info.GetStarted()).UTC().Format(time.RFC3339),
+	)
+}
+
+// unaryInfoInterceptor identifies the server in the headers and trailers of
+// each call, which the clients get even when the call fails
+func (s *PingService) unaryInfoInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := grpc.SetHeader(ctx, s.infoMD); err != nil {
+		log.WithError(err).Debug("error setting server info header")
+	}
+	if err := grpc.SetTrailer(ctx, s.infoMD); err != nil {
+		log.WithError(err).Debug("error setting server info trailer")
+	}
+	return handler(ctx, req)
+}
+
+// streamInfoInterceptor identifies the server in the headers and trailers of
+// each stream
+func (s *PingService) streamInfoInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := ss.SetHeader(s.infoMD); err != nil {
+		log.WithError(err).Debug("error setting server info header")
+	}
+	ss.SetTrailer(s.infoMD)
+	return handler(srv, ss)
+}
+
+// GetInfo returns the identity of this server instance
+func (s *PingService) GetInfo(ctx context.Context, req *pb.GetInfoRequest) (*pb.ServerInfo, error) {
+	return s.info, nil
+}
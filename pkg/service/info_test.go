@@ -0,0 +1,137 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"github.com/mchmarny/grpc-lab/pkg/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestServerInfo(t *testing.T) {
+	lis := startBufconnServer(t, WithVersion("v1.2.3"), WithFaultInjection(true))
+	c := pb.NewServiceClient(dialConn(t, lis))
+	ctx := context.Background()
+
+	info, err := c.GetInfo(ctx, &pb.GetInfoRequest{})
+	require.NoError(t, err)
+	assert.NotEmpty(t, info.InstanceID)
+	assert.NotEmpty(t, info.Hostname)
+	assert.Equal(t, "v1.2.3", info.Version)
+	assert.WithinDuration(t, time.Now(), time.Unix(0, info.Started), time.Minute)
+
+	assertInfoMD := func(t *testing.T, md metadata.MD) {
+		t.Helper()
+		assert.Equal(t, []string{info.InstanceID}, md.Get(ServerInstanceKey))
+		assert.Equal(t, []string{info.Hostname}, md.Get(ServerHostnameKey))
+		assert.Equal(t, []string{"v1.2.3"}, md.Get(ServerVersionKey))
+		assert.Len(t, md.Get(ServerStartedKey), 1)
+	}
+
+	t.Run("ping", func(t *testing.T) {
+		var header, trailer metadata.MD
+		res, err := c.Ping(ctx, getTestRequest(), grpc.Header(&header), grpc.Trailer(&trailer))
+		require.NoError(t, err)
+		assert.True(t, proto.Equal(info, res.Server))
+		assertInfoMD(t, header)
+		assertInfoMD(t, trailer)
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		var trailer metadata.MD
+		fctx := metadata.AppendToOutgoingContext(ctx, FaultCodeKey, "UNAVAILABLE")
+		_, err := c.Ping(fctx, getTestRequest(), grpc.Trailer(&trailer))
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+		assertInfoMD(t, trailer)
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		stream, err := c.Stream(ctx)
+		require.NoError(t, err)
+		require.NoError(t, stream.Send(getTestRequest()))
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		assert.True(t, proto.Equal(info, res.Server))
+
+		header, err := stream.Header()
+		require.NoError(t, err)
+		assertInfoMD(t, header)
+		require.NoError(t, stream.CloseSend())
+		_, err = stream.Recv()
+		require.Error(t, err)
+		assertInfoMD(t, stream.Trailer())
+	})
+}
+
+func TestServerInfoReplicas(t *testing.T) {
+	listeners := make(map[string]*bufconn.Listener)
+	addrs := make([]string, 0)
+	for i := 0; i < 2; i++ {
+		addr := fmt.Sprintf("replica-%d:50505", i)
+		listeners[addr] = startBufconnServer(t)
+		addrs = append(addrs, addr)
+	}
+	dialer := func(ctx context.Context, addr string) (net.Conn, error) {
+		return listeners[addr].DialContext(ctx)
+	}
+
+	// records the replica which served each response
+	var lock sync.Mutex
+	counts := make(map[string]int)
+	recordServer := func(ctx context.Context, method string, req, reply interface{},
+		cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if res, ok := reply.(*pb.PingResponse); ok && err == nil {
+			lock.Lock()
+			counts[res.Server.InstanceID]++
+			lock.Unlock()
+		}
+		return err
+	}
+	resetCounts := func() map[string]int {
+		lock.Lock()
+		defer lock.Unlock()
+		c := counts
+		counts = make(map[string]int)
+		return c
+	}
+
+	c, err := client.NewPingClient(context.Background(), strings.Join(addrs, ","), "test",
+		client.WithBalancer(client.RoundRobin),
+		client.WithDialOptions(grpc.WithContextDialer(dialer), grpc.WithChainUnaryInterceptor(recordServer)))
+	require.NoError(t, err)
+	t.Cleanup(c.Close)
+
+	// wait for both replicas to be ready
+	require.Eventually(t, func() bool {
+		for i := 0; i < 4; i++ {
+			if _, _, err := c.Ping(context.Background(), "hi"); err != nil {
+				return false
+			}
+		}
+		return len(resetCounts()) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		_, _, err := c.Ping(context.Background(), "hi")
+		require.NoError(t, err)
+	}
+	served := resetCounts()
+	require.Len(t, served, 2, "responses identify the replica")
+	for id, n := range served {
+		assert.Equal(t, 5, n, id)
+	}
+}
@@ -0,0 +1,171 @@
+package service
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// ClientIDKey is the metadata key identifying the calling client
+	ClientIDKey = "client-id"
+)
+
+// unaryInterceptors returns the built-in interceptors followed by the ones
+// appended through options, in the order they are invoked. Recovery follows
+// the logging and metrics so panics in later interceptors are still logged and
+// counted, as are the injected faults.
+func (s *PingService) unaryInterceptors() []grpc.UnaryServerInterceptor {
+	list := []grpc.UnaryServerInterceptor{
+		otelgrpc.UnaryServerInterceptor(s.otelOptions()...),
+		s.metrics.unaryInterceptor,
+		unaryAccessLogInterceptor,
+		s.unaryInfoInterceptor,
+		s.unaryRecoveryInterceptor,
+		s.faults.unaryInterceptor,
+	}
+	return append(list, s.unaryInts...)
+}
+
+// streamInterceptors returns the built-in interceptors followed by the ones
+// appended through options, in the order they are invoked
+func (s *PingService) streamInterceptors() []grpc.StreamServerInterceptor {
+	list := []grpc.StreamServerInterceptor{
+		otelgrpc.StreamServerInterceptor(s.otelOptions()...),
+		s.metrics.streamInterceptor,
+		streamAccessLogInterceptor,
+		s.streamInfoInterceptor,
+		s.streamRecoveryInterceptor,
+		s.faults.streamInterceptor,
+	}
+	return append(list, s.streamInts...)
+}
+
+func unaryAccessLogInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	deadline := remainingDeadline(ctx)
+	res, err := handler(ctx, req)
+
+	fields := accessLogFields(ctx, info.FullMethod, start, err)
+	fields["deadline"] = deadline
+	fields["bytes_in"] = messageSize(req)
+	fields["bytes_out"] = messageSize(res)
+	if _, ok := fields["client_id"]; !ok {
+		if id := contentClientID(req); id != "" {
+			fields["client_id"] = id
+		}
+	}
+	log.WithFields(fields).Info("unary call")
+	return res, err
+}
+
+func streamAccessLogInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	deadline := remainingDeadline(ss.Context())
+	cs := &countingStream{ServerStream: ss}
+	err := handler(srv, cs)
+
+	fields := accessLogFields(ss.Context(), info.FullMethod, start, err)
+	fields["deadline"] = deadline
+	fields["bytes_in"] = int(atomic.LoadInt64(&cs.bytesIn))
+	fields["bytes_out"] = int(atomic.LoadInt64(&cs.bytesOut))
+	fields["messages_in"] = int(atomic.LoadInt64(&cs.msgsIn))
+	fields["messages_out"] = int(atomic.LoadInt64(&cs.msgsOut))
+	log.WithFields(fields).Info("stream call")
+	return err
+}
+
+func accessLogFields(ctx context.Context, method string, start time.Time, err error) log.Fields {
+	fields := log.Fields{
+		"method":  method,
+		"latency": time.Since(start).String(),
+		"code":    status.Code(err).String(),
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		fields["peer"] = p.Addr.String()
+	}
+	if id := metadataClientID(ctx); id != "" {
+		fields["client_id"] = id
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+	return fields
+}
+
+// remainingDeadline returns the time left until the call deadline as the call
+// arrives, which shows how the deadlines propagate from the clients and the
+// HTTP gateway (grpc-timeout header), or none when the call has no deadline
+func remainingDeadline(ctx context.Context) string {
+	d, ok := ctx.Deadline()
+	if !ok {
+		return "none"
+	}
+	return time.Until(d).Round(time.Millisecond).String()
+}
+
+// metadataClientID returns the client ID from the incoming call metadata
+func metadataClientID(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if v := md.Get(ClientIDKey); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// contentClientID returns the client ID from the request content metadata
+func contentClientID(req interface{}) string {
+	r, ok := req.(interface{ GetContent() *pb.Content })
+	if !ok {
+		return ""
+	}
+	return r.GetContent().GetMetadata()[ClientIDKey]
+}
+
+func messageSize(m interface{}) int {
+	if msg, ok := m.(proto.Message); ok {
+		return proto.Size(msg)
+	}
+	return 0
+}
+
+// countingStream counts the messages and bytes passing through the stream.
+// Handlers may receive and send from different goroutines so the counters
+// are updated atomically.
+type countingStream struct {
+	grpc.ServerStream
+	msgsIn   int64
+	msgsOut  int64
+	bytesIn  int64
+	bytesOut int64
+}
+
+func (s *countingStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		atomic.AddInt64(&s.msgsIn, 1)
+		atomic.AddInt64(&s.bytesIn, int64(messageSize(m)))
+	}
+	return err
+}
+
+func (s *countingStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		atomic.AddInt64(&s.msgsOut, 1)
+		atomic.AddInt64(&s.bytesOut, int64(messageSize(m)))
+	}
+	return err
+}
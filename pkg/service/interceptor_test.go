@@ -0,0 +1,139 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mchmarny/grpc-lab/pkg/client"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func TestAccessLogInterceptor(t *testing.T) {
+	hook := test.NewGlobal()
+	t.Cleanup(func() { log.StandardLogger().ReplaceHooks(make(log.LevelHooks)) })
+
+	lis := startBufconnServer(t)
+	c := dialBufconn(t, lis)
+
+	t.Run("unary", func(t *testing.T) {
+		hook.Reset()
+		_, _, err := c.Ping(context.Background(), "test")
+		require.NoError(t, err)
+
+		e := findLogEntry(hook, "unary call")
+		require.NotNil(t, e)
+		assert.Equal(t, pingMethod, e.Data["method"])
+		assert.Equal(t, "test", e.Data["client_id"])
+		assert.Equal(t, "OK", e.Data["code"])
+		assert.NotEmpty(t, e.Data["peer"])
+		assert.NotEmpty(t, e.Data["latency"])
+		assert.Greater(t, e.Data["bytes_in"], 0)
+		assert.Greater(t, e.Data["bytes_out"], 0)
+		assert.NotEqual(t, "none", e.Data["deadline"], "unary calls have the client timeout")
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		hook.Reset()
+		_, err := c.StreamList(context.Background(), []string{"a", "b"})
+		require.NoError(t, err)
+
+		var e *log.Entry
+		require.Eventually(t, func() bool {
+			e = findLogEntry(hook, "stream call")
+			return e != nil
+		}, time.Second, 10*time.Millisecond)
+		assert.Equal(t, streamMethod, e.Data["method"])
+		assert.Equal(t, "test", e.Data["client_id"])
+		assert.Equal(t, 2, e.Data["messages_in"])
+		assert.Equal(t, 2, e.Data["messages_out"])
+		assert.Equal(t, "none", e.Data["deadline"], "streams have no deadline by default")
+	})
+}
+
+func TestAccessLogDeadline(t *testing.T) {
+	hook := test.NewGlobal()
+	t.Cleanup(func() { log.StandardLogger().ReplaceHooks(make(log.LevelHooks)) })
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := NewPingService(lis)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { _ = srv.Start(ctx) }()
+	t.Cleanup(cancel)
+	httpAddr := freeAddr(t)
+	go func() { _ = srv.StartHTTP(ctx, httpAddr) }()
+
+	t.Run("client", func(t *testing.T) {
+		c := dialBufconn(t, startBufconnServer(t), client.WithTimeout(time.Minute))
+		hook.Reset()
+		_, _, err := c.Ping(context.Background(), "test")
+		require.NoError(t, err)
+		e := findLogEntry(hook, "unary call")
+		require.NotNil(t, e)
+		d, err := time.ParseDuration(e.Data["deadline"].(string))
+		require.NoError(t, err)
+		assert.InDelta(t, time.Minute, d, float64(time.Second))
+	})
+
+	t.Run("gateway", func(t *testing.T) {
+		body := []byte(`{"content": {"id": "id1", "data": "dGVzdA=="}}`)
+		require.Eventually(t, func() bool {
+			hook.Reset()
+			req, err := http.NewRequest(http.MethodPost, "http://"+httpAddr+"/v1/ping", bytes.NewReader(body))
+			require.NoError(t, err)
+			req.Header.Set("Grpc-Timeout", "30S")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return false
+			}
+			resp.Body.Close()
+			return resp.StatusCode == http.StatusOK
+		}, 3*time.Second, 20*time.Millisecond)
+
+		e := findLogEntry(hook, "unary call")
+		require.NotNil(t, e)
+		d, err := time.ParseDuration(e.Data["deadline"].(string))
+		require.NoError(t, err)
+		assert.InDelta(t, 30*time.Second, d, float64(time.Second), "the gateway propagates the grpc-timeout header")
+	})
+}
+
+func TestCustomInterceptors(t *testing.T) {
+	var unaryMethods, streamMethods []string
+	unary := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		unaryMethods = append(unaryMethods, info.FullMethod)
+		return handler(ctx, req)
+	}
+	stream := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		streamMethods = append(streamMethods, info.FullMethod)
+		return handler(srv, ss)
+	}
+
+	lis := startBufconnServer(t, WithUnaryInterceptors(unary), WithStreamInterceptors(stream))
+	c := dialBufconn(t, lis)
+
+	_, _, err := c.Ping(context.Background(), "test")
+	require.NoError(t, err)
+	_, err = c.StreamList(context.Background(), []string{"a"})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{pingMethod}, unaryMethods)
+	assert.Equal(t, []string{streamMethod}, streamMethods)
+}
+
+func findLogEntry(hook *test.Hook, msg string) *log.Entry {
+	for _, e := range hook.AllEntries() {
+		if e.Message == msg {
+			return e
+		}
+	}
+	return nil
+}
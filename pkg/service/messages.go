@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"strconv"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"github.com/mchmarny/grpc-lab/pkg/store"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 1000
+)
+
+// ListMessages returns the recently processed messages, newest first
+func (s *PingService) ListMessages(ctx context.Context, req *pb.ListMessagesRequest) (*pb.ListMessagesResponse, error) {
+	q, err := messageQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := s.store.ListMessages(q)
+	if err != nil {
+		log.WithError(err).Error("error listing messages")
+		return nil, status.Error(codes.Internal, "error listing messages")
+	}
+
+	res := &pb.ListMessagesResponse{Messages: page.Messages}
+	if page.Next != 0 {
+		res.NextPageToken = encodePageToken(page.Next)
+	}
+	return res, nil
+}
+
+// GetMessage returns the most recently processed message with the content ID
+func (s *PingService) GetMessage(ctx context.Context, req *pb.GetMessageRequest) (*pb.Message, error) {
+	if req.GetId() == "" {
+		return nil, invalidArgument([]*errdetails.BadRequest_FieldViolation{
+			violation("id", "is required"),
+		})
+	}
+
+	m, err := s.store.GetMessage(req.GetId())
+	if err != nil {
+		log.WithError(err).Errorf("error reading message: %s", req.GetId())
+		return nil, status.Error(codes.Internal, "error reading message")
+	}
+	if m == nil {
+		return nil, status.Errorf(codes.NotFound, "message not found: %s", req.GetId())
+	}
+	return m, nil
+}
+
+// messageQuery validates the request and converts it into a store query
+func messageQuery(req *pb.ListMessagesRequest) (*store.MessageQuery, error) {
+	list := make([]*errdetails.BadRequest_FieldViolation, 0)
+	q := &store.MessageQuery{Limit: int(req.GetPageSize())}
+
+	switch {
+	case q.Limit < 0:
+		list = append(list, violation("pageSize", "must not be negative"))
+	case q.Limit == 0:
+		q.Limit = defaultPageSize
+	case q.Limit > maxPageSize:
+		q.Limit = maxPageSize
+	}
+
+	if req.GetPageToken() != "" {
+		before, ok := decodePageToken(req.GetPageToken())
+		if !ok {
+			list = append(list, violation("pageToken", "is invalid"))
+		}
+		q.Before = before
+	}
+
+	if req.GetMetadataValue() != "" && req.GetMetadataKey() == "" {
+		list = append(list, violation("metadataKey", "is required when metadataValue is set"))
+	}
+
+	start, end := req.GetStartTime(), req.GetEndTime()
+	if start != 0 && end != 0 && start >= end {
+		list = append(list, violation("endTime", "must be after startTime"))
+	}
+
+	if len(list) > 0 {
+		return nil, invalidArgument(list)
+	}
+
+	matches := messageFilter(req.GetClientID(), req.GetMetadataKey(), req.GetMetadataValue())
+	q.Match = func(m *pb.Message) bool {
+		if !matches(m) {
+			return false
+		}
+		if start != 0 && m.GetProcessed() < start {
+			return false
+		}
+		if end != 0 && m.GetProcessed() >= end {
+			return false
+		}
+		return true
+	}
+	return q, nil
+}
+
+// messageFilter returns a func matching the messages of the client with the
+// metadata key and value. Empty arguments match all messages, and an empty
+// value matches any message with the key.
+func messageFilter(clientID, key, value string) func(*pb.Message) bool {
+	return func(m *pb.Message) bool {
+		if clientID != "" && m.GetClientID() != clientID {
+			return false
+		}
+		if key != "" {
+			v, ok := m.GetContent().GetMetadata()[key]
+			if !ok || (value != "" && v != value) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// encodePageToken returns an opaque token for the store cursor
+func encodePageToken(cursor uint64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatUint(cursor, 10)))
+}
+
+// decodePageToken returns the store cursor from the token
+func decodePageToken(token string) (uint64, bool) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, false
+	}
+	cursor, err := strconv.ParseUint(string(b), 10, 64)
+	if err != nil || cursor == 0 {
+		return 0, false
+	}
+	return cursor, true
+}
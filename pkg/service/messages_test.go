@@ -0,0 +1,180 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestListMessages(t *testing.T) {
+	lis := startBufconnServer(t)
+	c := pb.NewServiceClient(dialConn(t, lis))
+	ctx := context.Background()
+
+	var middle int64
+	for i := 0; i < 6; i++ {
+		clientID := []string{"a", "b"}[i%2]
+		req := getTestRequest()
+		req.Content.Id = fmt.Sprintf("id%d", i)
+		req.Content.Metadata["index"] = fmt.Sprintf("%d", i)
+		if i < 2 {
+			req.Content.Metadata["first"] = "yes"
+		}
+		res, err := c.Ping(metadata.AppendToOutgoingContext(ctx, ClientIDKey, clientID), req)
+		require.NoError(t, err)
+		if i == 3 {
+			middle = res.Processed
+		}
+	}
+
+	tests := []struct {
+		name string
+		req  *pb.ListMessagesRequest
+		ids  []string
+	}{
+		{"all", &pb.ListMessagesRequest{}, []string{"id5", "id4", "id3", "id2", "id1", "id0"}},
+		{"client", &pb.ListMessagesRequest{ClientID: "a"}, []string{"id4", "id2", "id0"}},
+		{"metadata key", &pb.ListMessagesRequest{MetadataKey: "first"}, []string{"id1", "id0"}},
+		{"metadata value", &pb.ListMessagesRequest{MetadataKey: "index", MetadataValue: "3"}, []string{"id3"}},
+		{"start time", &pb.ListMessagesRequest{StartTime: middle}, []string{"id5", "id4", "id3"}},
+		{"end time", &pb.ListMessagesRequest{EndTime: middle}, []string{"id2", "id1", "id0"}},
+		{"time range", &pb.ListMessagesRequest{StartTime: middle, EndTime: middle + 1}, []string{"id3"}},
+		{"no match", &pb.ListMessagesRequest{ClientID: "c"}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := c.ListMessages(ctx, tt.req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.ids, listedIDs(res))
+			assert.Empty(t, res.NextPageToken)
+		})
+	}
+
+	t.Run("pages", func(t *testing.T) {
+		req := &pb.ListMessagesRequest{PageSize: 2, ClientID: "b"}
+		res, err := c.ListMessages(ctx, req)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"id5", "id3"}, listedIDs(res))
+		require.NotEmpty(t, res.NextPageToken)
+
+		req.PageToken = res.NextPageToken
+		res, err = c.ListMessages(ctx, req)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"id1"}, listedIDs(res))
+		assert.Empty(t, res.NextPageToken)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := c.ListMessages(ctx, &pb.ListMessagesRequest{
+			PageSize:      -1,
+			PageToken:     "invalid",
+			MetadataValue: "v",
+			StartTime:     2,
+			EndTime:       1,
+		})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		assert.Equal(t, []string{"pageSize", "pageToken", "metadataKey", "endTime"}, violationFields(t, err))
+	})
+
+	t.Run("get", func(t *testing.T) {
+		m, err := c.GetMessage(ctx, &pb.GetMessageRequest{Id: "id3"})
+		require.NoError(t, err)
+		assert.Equal(t, "id3", m.Content.Id)
+		assert.Equal(t, "b", m.ClientID)
+		assert.Equal(t, pingMethodName, m.Method)
+		assert.Equal(t, middle, m.Processed)
+
+		_, err = c.GetMessage(ctx, &pb.GetMessageRequest{Id: "missing"})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+
+		_, err = c.GetMessage(ctx, &pb.GetMessageRequest{})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
+
+func TestPageToken(t *testing.T) {
+	cursor, ok := decodePageToken(encodePageToken(42))
+	assert.True(t, ok)
+	assert.Equal(t, uint64(42), cursor)
+
+	for _, token := range []string{"!", encodePageToken(0), "YWJj"} {
+		_, ok := decodePageToken(token)
+		assert.False(t, ok, token)
+	}
+}
+
+func TestMessagesGateway(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := NewPingService(lis)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { _ = srv.Start(ctx) }()
+	t.Cleanup(cancel)
+
+	httpAddr := freeAddr(t)
+	go func() { _ = srv.StartHTTP(ctx, httpAddr) }()
+
+	for _, id := range []string{"id1", "id2"} {
+		req := getTestRequest()
+		req.Content.Id = id
+		_, err = srv.processReq(ctx, pingMethodName, req)
+		require.NoError(t, err)
+	}
+
+	var resp *http.Response
+	require.Eventually(t, func() bool {
+		resp, err = http.Get("http://" + httpAddr + "/v1/messages?pageSize=1&clientID=test")
+		return err == nil
+	}, 3*time.Second, 20*time.Millisecond)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var list struct {
+		Messages []struct {
+			Content struct {
+				ID string `json:"id"`
+			} `json:"content"`
+		} `json:"messages"`
+		NextPageToken string `json:"nextPageToken"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+	require.Len(t, list.Messages, 1)
+	assert.Equal(t, "id2", list.Messages[0].Content.ID)
+	assert.NotEmpty(t, list.NextPageToken)
+
+	resp, err = http.Get("http://" + httpAddr + "/v1/messages/id1")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var msg struct {
+		ClientID string `json:"clientID"`
+		Method   string `json:"method"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&msg))
+	assert.Equal(t, "test", msg.ClientID)
+	assert.Equal(t, pingMethodName, msg.Method)
+
+	resp, err = http.Get("http://" + httpAddr + "/v1/messages/missing")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func listedIDs(res *pb.ListMessagesResponse) []string {
+	ids := make([]string, 0, len(res.Messages))
+	for _, m := range res.Messages {
+		ids = append(ids, m.Content.Id)
+	}
+	return ids
+}
@@ -0,0 +1,205 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	metricsNamespace = "ping"
+)
+
+// serverMetrics holds the collectors of the ping service in its own registry
+// so multiple services can coexist in a single process
+type serverMetrics struct {
+	registry       *prometheus.Registry
+	grpcRequests   *prometheus.CounterVec
+	grpcLatency    *prometheus.HistogramVec
+	streamMessages *prometheus.HistogramVec
+	activeStreams  *prometheus.GaugeVec
+	panics         *prometheus.CounterVec
+	httpRequests   *prometheus.CounterVec
+	httpLatency    *prometheus.HistogramVec
+	dedupLookups   *prometheus.CounterVec
+
+	subscribers           prometheus.Gauge
+	subscriberDrops       prometheus.Counter
+	subscriberDisconnects prometheus.Counter
+
+	rooms           prometheus.Gauge
+	roomDisconnects prometheus.Counter
+
+	faults *prometheus.CounterVec
+}
+
+func newServerMetrics(s *PingService) *serverMetrics {
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		grpcRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "grpc_requests_total",
+			Help:      "Total number of gRPC calls completed by method and status code.",
+		}, []string{"method", "code"}),
+		grpcLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "grpc_handling_seconds",
+			Help:      "Duration of gRPC calls by method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method"}),
+		streamMessages: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "grpc_stream_messages",
+			Help:      "Number of messages per gRPC stream by method and direction.",
+			Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+		}, []string{"method", "direction"}),
+		activeStreams: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "grpc_active_streams",
+			Help:      "Number of gRPC streams currently open by method.",
+		}, []string{"method"}),
+		panics: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "grpc_panics_total",
+			Help:      "Total number of panics recovered in gRPC handlers by method.",
+		}, []string{"method"}),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "Total number of HTTP gateway requests by method and status code.",
+		}, []string{"method", "code"}),
+		httpLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Duration of HTTP gateway requests by method and status code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "code"}),
+		dedupLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "dedup_lookups_total",
+			Help:      "Total number of content ID deduplication lookups by result (hit or miss).",
+		}, []string{"result"}),
+		subscribers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "subscribers",
+			Help:      "Number of subscribers currently receiving processed messages.",
+		}),
+		subscriberDrops: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "subscriber_dropped_messages_total",
+			Help:      "Total number of messages dropped because a subscriber buffer was full.",
+		}),
+		subscriberDisconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "subscriber_disconnects_total",
+			Help:      "Total number of subscribers disconnected because their buffer was full.",
+		}),
+		rooms: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "rooms",
+			Help:      "Number of rooms with at least one stream joined.",
+		}),
+		roomDisconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "room_disconnects_total",
+			Help:      "Total number of streams disconnected from rooms because their buffer was full.",
+		}),
+		faults: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "faults_injected_total",
+			Help:      "Total number of faults injected into gRPC calls by method and fault (delay, hang, error, or abort).",
+		}, []string{"method", "fault"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.grpcRequests,
+		m.grpcLatency,
+		m.streamMessages,
+		m.activeStreams,
+		m.panics,
+		m.httpRequests,
+		m.httpLatency,
+		m.dedupLookups,
+		m.subscribers,
+		m.subscriberDrops,
+		m.subscriberDisconnects,
+		m.rooms,
+		m.roomDisconnects,
+		m.faults,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "messages_processed",
+			Help:      "Current count of messages processed by the service.",
+		}, func() float64 {
+			return float64(s.getMessageCount())
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "tls_cert_reloads_total",
+			Help:      "Total number of TLS certificate reloads.",
+		}, func() float64 {
+			if !s.tlsEnabled() {
+				return 0
+			}
+			certs, err := s.certReloader()
+			if err != nil {
+				return 0
+			}
+			return float64(certs.ReloadCount())
+		}),
+	)
+	return m
+}
+
+// observeDedup counts a deduplication lookup as a hit when the response of
+// the duplicate message was returned
+func (m *serverMetrics) observeDedup(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.dedupLookups.WithLabelValues(result).Inc()
+}
+
+// handler returns the HTTP handler exposing the metrics
+func (m *serverMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// instrumentHTTP wraps the HTTP handler with request count and duration metrics
+func (m *serverMetrics) instrumentHTTP(h http.Handler) http.Handler {
+	return promhttp.InstrumentHandlerCounter(m.httpRequests,
+		promhttp.InstrumentHandlerDuration(m.httpLatency, h))
+}
+
+func (m *serverMetrics) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	res, err := handler(ctx, req)
+	m.grpcRequests.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+	m.grpcLatency.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+	return res, err
+}
+
+func (m *serverMetrics) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	active := m.activeStreams.WithLabelValues(info.FullMethod)
+	active.Inc()
+	defer active.Dec()
+
+	cs := &countingStream{ServerStream: ss}
+	err := handler(srv, cs)
+	m.grpcRequests.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+	m.grpcLatency.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+	m.streamMessages.WithLabelValues(info.FullMethod, "received").Observe(float64(atomic.LoadInt64(&cs.msgsIn)))
+	m.streamMessages.WithLabelValues(info.FullMethod, "sent").Observe(float64(atomic.LoadInt64(&cs.msgsOut)))
+	return err
+}
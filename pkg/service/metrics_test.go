@@ -0,0 +1,87 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const (
+	pingMethod   = "/io.thingz.grpc.v1.Service/Ping"
+	streamMethod = "/io.thingz.grpc.v1.Service/Stream"
+)
+
+func TestGRPCMetrics(t *testing.T) {
+	lis := bufconn.Listen(1024 * 1024)
+	srv := NewPingService(lis)
+	go func() { _ = srv.Start(context.Background()) }()
+	t.Cleanup(func() { lis.Close() })
+	m := srv.metrics
+
+	c := dialBufconn(t, lis)
+	_, _, err := c.Ping(context.Background(), "test")
+	require.NoError(t, err)
+	_, _, err = c.Ping(context.Background(), "test")
+	require.NoError(t, err)
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.grpcRequests.WithLabelValues(pingMethod, "OK")))
+	assert.Equal(t, 1, testutil.CollectAndCount(m.grpcLatency))
+
+	stream := openTestStream(t, lis)
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.activeStreams.WithLabelValues(streamMethod)))
+	require.NoError(t, stream.CloseSend())
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(m.activeStreams.WithLabelValues(streamMethod)) == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.grpcRequests.WithLabelValues(streamMethod, "OK")))
+	assert.Equal(t, 2, testutil.CollectAndCount(m.streamMessages))
+	assert.Equal(t, int64(3), srv.getMessageCount())
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := NewPingService(lis)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { _ = srv.Start(ctx) }()
+	t.Cleanup(cancel)
+
+	httpAddr := freeAddr(t)
+	go func() { _ = srv.StartHTTP(ctx, httpAddr) }()
+
+	body := []byte(`{"content": {"id": "id1", "data": "dGVzdA=="}}`)
+	require.Eventually(t, func() bool {
+		resp, err := http.Post("http://"+httpAddr+"/v1/ping", "application/json", bytes.NewReader(body))
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 3*time.Second, 20*time.Millisecond)
+
+	resp, err := http.Get("http://" + httpAddr + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	out := string(b)
+	assert.Contains(t, out, `ping_http_requests_total{code="200",method="post"} 1`)
+	assert.Contains(t, out, `ping_grpc_requests_total{code="OK",method="`+pingMethod+`"} 1`)
+	assert.Contains(t, out, "ping_messages_processed 1")
+	assert.Contains(t, out, "ping_tls_cert_reloads_total 0")
+	assert.Contains(t, out, "go_goroutines")
+}
@@ -0,0 +1,145 @@
+package service
+
+import (
+	"time"
+
+	"github.com/mchmarny/grpc-lab/pkg/format"
+	"github.com/mchmarny/grpc-lab/pkg/store"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+)
+
+// Option configures the PingService
+type Option func(*PingService)
+
+// WithTLS enables TLS using the PEM encoded certificate and key files.
+// When caFile is set, clients must also present a certificate signed by
+// one of the CAs in that bundle (mTLS). In that case, the certificate is also
+// used by the HTTP gateway to authenticate to the gRPC server so it must be
+// valid for client authentication.
+func WithTLS(certFile, keyFile, caFile string) Option {
+	return func(s *PingService) {
+		s.certFile = certFile
+		s.keyFile = keyFile
+		s.caFile = caFile
+	}
+}
+
+// WithCertReloadInterval sets how often the TLS files are checked for changes.
+// Changed certificates are used for new handshakes without a restart.
+func WithCertReloadInterval(d time.Duration) Option {
+	return func(s *PingService) {
+		s.certReloadInterval = d
+	}
+}
+
+// WithDrainTimeout sets how long in-flight calls are given to complete
+// after the server context is canceled before the servers are stopped.
+func WithDrainTimeout(d time.Duration) Option {
+	return func(s *PingService) {
+		s.drainTimeout = d
+	}
+}
+
+// WithUnaryInterceptors appends unary interceptors to the server chain.
+// They are invoked in order, after the built-in ones.
+func WithUnaryInterceptors(interceptors ...grpc.UnaryServerInterceptor) Option {
+	return func(s *PingService) {
+		s.unaryInts = append(s.unaryInts, interceptors...)
+	}
+}
+
+// WithStreamInterceptors appends stream interceptors to the server chain.
+// They are invoked in order, after the built-in ones.
+func WithStreamInterceptors(interceptors ...grpc.StreamServerInterceptor) Option {
+	return func(s *PingService) {
+		s.streamInts = append(s.streamInts, interceptors...)
+	}
+}
+
+// WithTracerProvider sets the provider used to create spans.
+// Defaults to the global provider.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(s *PingService) {
+		s.tracerProvider = tp
+	}
+}
+
+// WithLimits sets the constraints each request is validated against
+func WithLimits(l Limits) Option {
+	return func(s *PingService) {
+		s.limits = l
+	}
+}
+
+// WithProcessors sets the registry of the processors requests can select with
+// the processor metadata key. Defaults to the built-in processors.
+func WithProcessors(r *format.Registry) Option {
+	return func(s *PingService) {
+		s.processors = r
+	}
+}
+
+// WithFaultInjection enables injecting faults into the service calls, which
+// is meant for lab deployments only. Disabled by default, in which case the
+// faults and the fault metadata are ignored and SetFaults is denied.
+func WithFaultInjection(enabled bool) Option {
+	return func(s *PingService) {
+		s.faultInjection = enabled
+	}
+}
+
+// WithFaults sets the faults injected into all the service calls until
+// replaced with SetFaults, when fault injection is enabled. Calls can
+// override them with the fault metadata.
+func WithFaults(f Faults) Option {
+	return func(s *PingService) {
+		s.initFaults = f
+	}
+}
+
+// WithStore sets the store the message counters and history are kept in.
+// By default they are kept in memory and lost on restart. The store is not
+// closed by the service.
+func WithStore(st store.Store) Option {
+	return func(s *PingService) {
+		s.store = st
+	}
+}
+
+// WithDedupWindow sets how long processed content IDs are remembered. Requests
+// with an ID the same client sent within the window get the original response
+// instead of being processed again. Zero disables the deduplication.
+func WithDedupWindow(d time.Duration) Option {
+	return func(s *PingService) {
+		s.dedupWindow = d
+	}
+}
+
+// WithDedupMaxEntries caps the number of remembered content IDs, the oldest
+// ones are forgotten first. Defaults to DefaultDedupMaxEntries, zero removes
+// the cap.
+func WithDedupMaxEntries(n int) Option {
+	return func(s *PingService) {
+		s.dedupMax = n
+	}
+}
+
+// WithSubscriberBuffer sets the number of responses buffered for each
+// subscriber and what happens to subscribers which fall further behind. The
+// size also bounds the responses queued for each stream, and streams falling
+// further behind their rooms are always disconnected to keep the room order.
+func WithSubscriberBuffer(size int, policy SlowConsumerPolicy) Option {
+	return func(s *PingService) {
+		s.subBuffer = size
+		s.subPolicy = policy
+	}
+}
+
+// WithVersion sets the server version returned with the server identity,
+// DefaultVersion unless set
+func WithVersion(v string) Option {
+	return func(s *PingService) {
+		s.version = v
+	}
+}
@@ -2,120 +2,515 @@ package service
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"github.com/mchmarny/grpc-lab/pkg/cert"
 	"github.com/mchmarny/grpc-lab/pkg/format"
+	"github.com/mchmarny/grpc-lab/pkg/store"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// DefaultDrainTimeout is the default time in-flight calls are given to complete on shutdown
+	DefaultDrainTimeout = 20 * time.Second
+
+	readHeaderTimeout = 10 * time.Second
 )
 
 // NewPingService creates an instance of the PingService
-func NewPingService(list net.Listener) *PingService {
-	return &PingService{
-		grpcListener: list,
+func NewPingService(list net.Listener, opts ...Option) *PingService {
+	s := &PingService{
+		grpcListener:   list,
+		drainTimeout:   DefaultDrainTimeout,
+		limits:         DefaultLimits,
+		health:         newHealthServer(),
+		tracerProvider: otel.GetTracerProvider(),
+		store:          store.NewMemoryStore(store.DefaultHistorySize),
+		dedupWindow:    DefaultDedupWindow,
+		dedupMax:       DefaultDedupMaxEntries,
+		subBuffer:      DefaultSubscriberBuffer,
+		subPolicy:      DropPolicy,
+		version:        DefaultVersion,
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.metrics = newServerMetrics(s)
+	s.dedup = newDedupCache(s.dedupWindow, s.dedupMax)
+	s.broker = newBroker(s.subBuffer, s.subPolicy, s.metrics)
+	s.rooms = newRoomRegistry(s.subBuffer, s.metrics)
+	s.faults = newFaultInjector(s.faultInjection, s.initFaults, s.metrics)
+	s.info = newServerInfo(s.version)
+	s.infoMD = infoMetadata(s.info)
+	if s.processors == nil {
+		s.processors = format.NewRegistry()
+	}
+	s.setServingStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+	return s
 }
 
 // PingService represents the server that responds to pings
 type PingService struct {
 	pb.UnimplementedServiceServer
-	messageCount int64
-	lock         sync.Mutex
-	grpcListener net.Listener
+	grpcListener   net.Listener
+	grpcServer     *grpc.Server
+	httpServer     *http.Server
+	httpWG         sync.WaitGroup
+	drainTimeout   time.Duration
+	limits         Limits
+	health         *healthServer
+	metrics        *serverMetrics
+	tracerProvider trace.TracerProvider
+	store          store.Store
+	dedupWindow    time.Duration
+	dedupMax       int
+	dedup          *dedupCache
+	subBuffer      int
+	subPolicy      SlowConsumerPolicy
+	broker         *broker
+	rooms          *roomRegistry
+	processors     *format.Registry
+	faultInjection bool
+	initFaults     Faults
+	faults         *faultInjector
+	version        string
+	info           *pb.ServerInfo
+	infoMD         metadata.MD
+	unaryInts      []grpc.UnaryServerInterceptor
+	streamInts     []grpc.StreamServerInterceptor
+
+	certFile           string
+	keyFile            string
+	caFile             string
+	certReloadInterval time.Duration
+	certs              *cert.Reloader
+	tlsOnce            sync.Once
+	tlsErr             error
 }
 
-// Start starts the ping service as a gRPC server
+// Start starts the ping service as a gRPC server and blocks until either the
+// server fails or the context is canceled. On cancellation, in-flight calls are
+// drained gracefully for up to the drain timeout before the server is stopped.
 func (s *PingService) Start(ctx context.Context) error {
-	opts := []grpc.ServerOption{}
-	grpcServer := grpc.NewServer(opts...)
-	reflection.Register(grpcServer)
-	pb.RegisterServiceServer(grpcServer, s)
+	opts, err := s.serverOptions()
+	if err != nil {
+		return err
+	}
+	if s.certs != nil {
+		go s.certs.Watch(ctx)
+	}
+	s.grpcServer = grpc.NewServer(opts...)
+	reflection.Register(s.grpcServer)
+	healthpb.RegisterHealthServer(s.grpcServer, s.health)
+	pb.RegisterServiceServer(s.grpcServer, s)
+
+	log.WithFields(log.Fields{
+		"instance": s.info.GetInstanceID(),
+		"version":  s.info.GetVersion(),
+	}).Infof("starting gRPC server at: %s", s.grpcListener.Addr().String())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.grpcServer.Serve(s.grpcListener)
+	}()
+	s.setServingStatus(healthpb.HealthCheckResponse_SERVING)
+
+	select {
+	case err := <-errCh:
+		s.health.Shutdown()
+		return err
+	case <-ctx.Done():
+	}
 
-	log.Infof("starting gRPC server at: %s", s.grpcListener.Addr().String())
-	return grpcServer.Serve(s.grpcListener)
+	log.Infof("shutting down gRPC server, draining for up to %v", s.drainTimeout)
+	// health watches and subscriptions never complete on their own so they
+	// would block the drain
+	s.health.Shutdown()
+	s.broker.close()
+	deadline := time.Now().Add(s.drainTimeout)
+
+	// let the HTTP gateway drain first as its requests are served by this server
+	if !waitUntil(&s.httpWG, deadline) {
+		log.Warn("HTTP server did not drain before deadline")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.grpcServer.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		log.Info("gRPC server drained")
+	case <-time.After(time.Until(deadline)):
+		log.Warn("gRPC server did not drain before deadline, stopping")
+		s.grpcServer.Stop()
+	}
+	return <-errCh
+}
+
+func (s *PingService) serverOptions() ([]grpc.ServerOption, error) {
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(s.unaryInterceptors()...),
+		grpc.ChainStreamInterceptor(s.streamInterceptors()...),
+	}
+	if !s.tlsEnabled() {
+		return opts, nil
+	}
+
+	certs, err := s.certReloader()
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading server certificates")
+	}
+	return append(opts, grpc.Creds(credentials.NewTLS(certs.ServerConfig()))), nil
 }
 
-// StartHTTP starts the ping service as a HTTP server
+// StartHTTP starts the ping service as a HTTP server and blocks until either the
+// server fails or the context is canceled. On cancellation, in-flight requests
+// are drained gracefully for up to the drain timeout before the server is closed.
 func (s *PingService) StartHTTP(ctx context.Context, addr string) error {
+	s.httpWG.Add(1)
+	defer s.httpWG.Done()
+
 	lis, err := net.Listen("tcp", addr)
 	if err != nil {
 		return errors.Wrapf(err, "error creating listener on %s: %v", addr, err)
 	}
 	defer lis.Close()
 
-	mux := runtime.NewServeMux()
-	opts := []grpc.DialOption{grpc.WithInsecure()}
+	gwMux := runtime.NewServeMux()
+	opts, err := s.gatewayDialOptions()
+	if err != nil {
+		return err
+	}
+	opts = append(opts, s.gatewayTracingDialOptions()...)
 
-	cancelCtx, cancel := context.WithCancel(ctx)
+	// the gateway connection outlives ctx so requests can drain during shutdown
+	gwCtx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	endpoint := s.grpcListener.Addr().String()
-	if err := pb.RegisterServiceHandlerFromEndpoint(cancelCtx, mux, endpoint, opts); err != nil {
+	if err := pb.RegisterServiceHandlerFromEndpoint(gwCtx, gwMux, endpoint, opts); err != nil {
 		return errors.Wrap(err, "error registering HTTP handler")
 	}
 
+	var gateway http.Handler = gwMux
+	if s.tlsEnabled() {
+		certs, err := s.certReloader()
+		if err != nil {
+			return errors.Wrap(err, "error loading server certificates")
+		}
+		// probes and metrics scrapers are not expected to have a client
+		// certificate so it is only required for the gateway
+		lis = tls.NewListener(lis, certs.OptionalClientCertConfig())
+		if certs.HasClientCAs() {
+			gateway = requireClientCert(gateway)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", s.traceHTTP(s.metrics.instrumentHTTP(gateway), "gateway"))
+	mux.Handle("/metrics", s.metrics.handler())
+	mux.HandleFunc("/healthz", healthHandler(s.health, ""))
+	mux.HandleFunc("/readyz", healthHandler(s.health, ServiceName))
+
+	s.httpServer = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+
 	log.Infof("starting REST server at %s", lis.Addr().String())
-	return http.Serve(lis, mux)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.httpServer.Serve(lis)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Infof("shutting down REST server, draining for up to %v", s.drainTimeout)
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), s.drainTimeout)
+	defer shutdownCancel()
+
+	if err := s.httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Warnf("REST server did not drain before deadline, closing: %v", err)
+		return s.httpServer.Close()
+	}
+	log.Info("REST server drained")
+	return nil
 }
 
-// Stream stream messages
+// waitUntil waits for the wait group and returns false if the deadline passed first
+func waitUntil(wg *sync.WaitGroup, deadline time.Time) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(time.Until(deadline)):
+		return false
+	}
+}
+
+// Stream stream messages. The messages are received and processed in their own
+// goroutine while the handler sends the queued responses, so the responses
+// broadcast to the stream from its rooms are sent in order with its own.
 func (s *PingService) Stream(stream pb.Service_StreamServer) error {
+	m := newMember(s.rooms.bufferSize)
+	if md, ok := metadata.FromIncomingContext(stream.Context()); ok {
+		for _, name := range md.Get(RoomKey) {
+			if name != "" {
+				s.rooms.join(name, m)
+			}
+		}
+	}
+	go s.receive(stream, m)
+
 	for {
-		err := contextError(stream.Context())
-		if err != nil {
-			return err
+		select {
+		case <-m.done:
+			log.WithError(m.err).Debug("stream ended")
+			return m.err
+		case res, ok := <-m.out:
+			if !ok {
+				return m.recvErr
+			}
+			if err := stream.Send(res); err != nil {
+				err = errors.Wrap(err, "error sending stream response")
+				m.stop(err)
+				return err
+			}
 		}
+	}
+}
 
-		req, err := stream.Recv()
-		if err == io.EOF {
-			log.Debug("no more data")
-			break
+// receive processes the stream messages until the client is done sending,
+// then leaves the rooms and closes the queue of the stream responses
+func (s *PingService) receive(stream pb.Service_StreamServer, m *member) {
+	var err error
+	defer func() {
+		// the recovery interceptor only covers the handler goroutine
+		if r := recover(); r != nil {
+			method, _ := grpc.MethodFromServerStream(stream)
+			err = s.recovered(method, r)
 		}
-		if err != nil {
-			return errors.Wrap(err, "error receiving stream")
+		s.rooms.leaveAll(m)
+		m.recvErr = err
+		close(m.out)
+	}()
+
+	for {
+		if err = contextError(stream.Context()); err != nil {
+			return
 		}
 
-		res := s.processReq(req)
+		req, recvErr := stream.Recv()
+		if recvErr == io.EOF {
+			log.Debug("no more data")
+			return
+		}
+		if recvErr != nil {
+			err = errors.Wrap(recvErr, "error receiving stream")
+			return
+		}
 
-		err = stream.Send(res)
-		if err != nil {
-			return errors.Wrap(err, "error sending stream response")
+		if err = s.streamMessage(stream.Context(), m, req); err != nil {
+			return
 		}
 	}
-	return nil
 }
 
 // Ping performs ping
-func (s *PingService) Ping(ctx context.Context, req *pb.PingRequest) (res *pb.PingResponse, err error) {
-	if req == nil {
-		return nil, errors.New("nil request")
+func (s *PingService) Ping(ctx context.Context, req *pb.PingRequest) (*pb.PingResponse, error) {
+	res, err := s.processReq(ctx, pingMethodName, req)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// streamMessage processes a single stream message within its own span. Invalid
+// messages are reported in the response result so the stream can continue.
+// Messages sent to a room are broadcast to the other streams in the room,
+// except for duplicates which were already broadcast when first processed.
+func (s *PingService) streamMessage(ctx context.Context, m *member, req *pb.PingRequest) error {
+	ctx, span := s.tracer().Start(ctx, "ping.stream.message")
+	defer span.End()
+
+	var publish func(*pb.PingResponse)
+	var published bool
+	var publishErr error
+	if name := req.GetContent().GetMetadata()[RoomKey]; name != "" {
+		span.SetAttributes(attribute.String("message.room", name))
+		// the response is stamped with the room sequence before it is cached,
+		// so duplicates get the same ack
+		publish = func(res *pb.PingResponse) {
+			broadcast := proto.Clone(res).(*pb.PingResponse)
+			broadcast.SenderID = requestClientID(ctx, req)
+			broadcast.Content = req.GetContent()
+			publishErr = s.rooms.publish(name, m, res, broadcast)
+			published = true
+		}
+	}
+
+	res, _, err := s.processMessage(ctx, streamMethodName, req, publish)
+	if err != nil {
+		span.RecordError(err)
+	}
+	if published {
+		return publishErr
 	}
-	res = s.processReq(req)
-	return
+	return m.send(res)
 }
 
-func (s *PingService) processReq(req *pb.PingRequest) *pb.PingResponse {
-	log.Infof("%+v", req)
+// processReq validates and processes the request, counting it against the
+// calling client. The returned response is always set, with the Error result
+// and message when the request is invalid, in which case the status error is
+// returned as well.
+func (s *PingService) processReq(ctx context.Context, method string, req *pb.PingRequest) (*pb.PingResponse, error) {
+	res, _, err := s.processMessage(ctx, method, req, nil)
+	return res, err
+}
 
-	s.lock.Lock()
-	s.messageCount++
-	s.lock.Unlock()
+// processMessage is processReq which also reports whether the response is the
+// one of a duplicate processed earlier. When set, publish is called with the
+// successful response of the original message before it is remembered for
+// the duplicates, and must not modify it afterwards.
+func (s *PingService) processMessage(ctx context.Context, method string, req *pb.PingRequest,
+	publish func(*pb.PingResponse)) (*pb.PingResponse, bool, error) {
+	content := req.GetContent()
+	clientID := requestClientID(ctx, req)
+	_, span := s.tracer().Start(ctx, "ping.process", trace.WithAttributes(
+		attribute.String("message.id", content.GetId()),
+		attribute.Int("message.size", len(content.GetData())),
+	))
+	defer span.End()
 
+	logger := log.WithFields(log.Fields{
+		"id":        content.GetId(),
+		"size":      len(content.GetData()),
+		"client_id": clientID,
+	})
+
+	err := validateRequest(req, s.limits)
+	var pipeline *format.Pipeline
+	if err == nil {
+		pipeline, err = s.requestPipeline(req)
+	}
+	if err != nil {
+		span.RecordError(err)
+		logger.WithError(err).Debug("invalid message")
+		return s.errorResponse(clientID, content.GetId(), err), false, err
+	}
+
+	span.SetAttributes(attribute.String("message.pipeline", pipeline.Name()))
+	key := dedupKey{clientID: clientID, id: content.GetId()}
+	res, err, duplicate := s.dedup.do(ctx, key, func() (*pb.PingResponse, error) {
+		logger.WithField("pipeline", pipeline.Name()).Debug("processing message")
+		res, err := s.process(clientID, method, pipeline, req)
+		if err == nil && publish != nil {
+			publish(res)
+		}
+		return res, err
+	})
+	if s.dedup.enabled() {
+		// duplicates which gave up waiting or whose original failed get no response
+		s.metrics.observeDedup(duplicate && res != nil)
+	}
+	span.SetAttributes(attribute.Bool("message.duplicate", duplicate))
+	if duplicate {
+		logger.Debug("duplicate message, returning original response")
+	}
+	if err != nil {
+		span.RecordError(err)
+	}
+	if res == nil {
+		res = s.errorResponse(clientID, content.GetId(), err)
+	}
+	return res, duplicate, err
+}
+
+// errorResponse returns the Error result response of the message which
+// failed with the status error
+func (s *PingService) errorResponse(clientID, id string, err error) *pb.PingResponse {
 	return &pb.PingResponse{
-		MessageID:    req.Content.Id,
-		MessageCount: s.messageCount,
+		MessageID:    id,
+		MessageCount: s.clientCount(clientID),
 		Processed:    time.Now().UTC().UnixNano(),
-		Detail:       fmt.Sprintf("Reversed: %s", format.ReverseString(string(req.Content.Data))),
+		Result:       pb.PingResponse_Error,
+		ErrorMessage: status.Convert(err).Message(),
+		Server:       s.info,
+	}
+}
+
+// process creates the response for the valid request and records it. Data
+// the pipeline fails to process is reported in the response like an invalid
+// request and is not recorded.
+func (s *PingService) process(clientID, method string, pipeline *format.Pipeline, req *pb.PingRequest) (*pb.PingResponse, error) {
+	content := req.GetContent()
+	res := &pb.PingResponse{
+		MessageID: content.GetId(),
+		Processed: time.Now().UTC().UnixNano(),
+		Result:    pb.PingResponse_Success,
+		Server:    s.info,
+	}
+
+	out, err := pipeline.ProcessLimited(content.GetData(), s.limits.MaxDataSize)
+	if err == nil && !utf8.Valid(out) {
+		err = errors.Errorf("%s output is not valid UTF-8", pipeline.Name())
+	}
+	if err != nil {
+		log.WithError(err).Debugf("error processing message: %s", content.GetId())
+		res.MessageCount = s.clientCount(clientID)
+		res.Result = pb.PingResponse_Error
+		res.ErrorMessage = err.Error()
+		return res, status.Error(codes.InvalidArgument, res.ErrorMessage)
+	}
+	res.Detail = fmt.Sprintf("%s: %s", pipeline.Label(), out)
+
+	msg := &pb.Message{
+		Content:   content,
+		ClientID:  clientID,
+		Method:    method,
+		Processed: res.Processed,
+	}
+	if err := s.recordMessage(msg, req, res); err != nil {
+		log.WithError(err).Errorf("error recording message: %s", content.GetId())
+		res.Result = pb.PingResponse_Error
+		res.ErrorMessage = "error recording message"
+		res.Detail = ""
+		return res, status.Error(codes.Internal, res.ErrorMessage)
 	}
+	s.broker.publish(msg, res)
+	return res, nil
 }
 
 func contextError(ctx context.Context) error {
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"github.com/mchmarny/grpc-lab/pkg/id"
 
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc/test/bufconn"
@@ -33,6 +34,8 @@ func TestPing(t *testing.T) {
 		}
 		assert.NotNil(t, resp)
 		assert.Exactly(t, req.Content.Id, resp.MessageID)
+		assert.Equal(t, pb.PingResponse_Success, resp.Result)
+		assert.Empty(t, resp.ErrorMessage)
 	})
 	t.Run("ping count", func(t *testing.T) {
 		req := getTestRequest()
@@ -45,20 +48,46 @@ func TestPing(t *testing.T) {
 		}
 		assert.NotNil(t, resp1)
 
-		resp2, err := srv.Ping(pingCtx, req)
+		resp2, err := srv.Ping(pingCtx, getTestRequest())
 		if err != nil {
 			t.Errorf("error on ping: %v", err)
 		}
 		assert.NotNil(t, resp2)
 		assert.True(t, resp2.MessageCount > resp1.MessageCount)
+
+		resp3, err := srv.Ping(pingCtx, req)
+		if err != nil {
+			t.Errorf("error on ping: %v", err)
+		}
+		assert.Equal(t, resp1.MessageCount, resp3.MessageCount, "duplicates are not counted")
 	})
 }
 
+func TestProcessReqResult(t *testing.T) {
+	srv := NewPingService(bufconn.Listen(1024 * 1024))
+	ctx := context.Background()
+
+	res, err := srv.processReq(ctx, pingMethodName, getTestRequest())
+	assert.NoError(t, err)
+	assert.Equal(t, pb.PingResponse_Success, res.Result)
+	assert.Equal(t, int64(1), res.MessageCount)
+
+	invalid := getTestRequest()
+	invalid.Content.Data = nil
+	res, err = srv.processReq(ctx, pingMethodName, invalid)
+	assert.Error(t, err)
+	assert.Equal(t, pb.PingResponse_Error, res.Result)
+	assert.Equal(t, invalid.Content.Id, res.MessageID)
+	assert.Equal(t, "invalid request: content.data is required", res.ErrorMessage)
+	assert.Empty(t, res.Detail)
+	assert.Equal(t, int64(1), res.MessageCount, "invalid messages are not counted")
+}
+
 func getTestRequest() *pb.PingRequest {
 	return &pb.PingRequest{
 		Sent: time.Now().UTC().UnixNano(),
 		Content: &pb.Content{
-			Id:   "test-id",
+			Id:   id.NewID(),
 			Data: []byte("test"),
 			Metadata: map[string]string{
 				"client-id": "test",
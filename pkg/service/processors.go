@@ -0,0 +1,26 @@
+package service
+
+import (
+	"fmt"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"github.com/mchmarny/grpc-lab/pkg/format"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+)
+
+const (
+	// ProcessorKey is the metadata key of the processor pipeline applied to the
+	// message data, e.g. reverse|upper. Defaults to format.DefaultPipeline.
+	ProcessorKey = "processor"
+)
+
+// requestPipeline returns the processor pipeline selected by the request
+func (s *PingService) requestPipeline(req *pb.PingRequest) (*format.Pipeline, error) {
+	p, err := s.processors.Pipeline(req.GetContent().GetMetadata()[ProcessorKey])
+	if err != nil {
+		return nil, invalidArgument([]*errdetails.BadRequest_FieldViolation{
+			violation(fmt.Sprintf("content.metadata[%s]", ProcessorKey), err.Error()),
+		})
+	}
+	return p, nil
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"github.com/mchmarny/grpc-lab/pkg/format"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestProcessors(t *testing.T) {
+	lis := startBufconnServer(t)
+	c := pb.NewServiceClient(dialConn(t, lis))
+	ctx := context.Background()
+
+	ping := func(spec, data string) (*pb.PingResponse, error) {
+		req := getTestRequest()
+		req.Content.Data = []byte(data)
+		if spec != "" {
+			req.Content.Metadata[ProcessorKey] = spec
+		}
+		return c.Ping(ctx, req)
+	}
+
+	t.Run("default", func(t *testing.T) {
+		res, err := ping("", "test")
+		require.NoError(t, err)
+		assert.Equal(t, "Reversed: tset", res.Detail)
+	})
+
+	t.Run("pipeline", func(t *testing.T) {
+		res, err := ping("reverse|upper", "test")
+		require.NoError(t, err)
+		assert.Equal(t, "Reversed, Uppercased: TSET", res.Detail)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		_, err := ping("reverse|nope", "test")
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		assert.Equal(t, []string{"content.metadata[processor]"}, violationFields(t, err))
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		_, err := ping(strings.Repeat("base64-encode|", 50)+"echo", "test")
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		assert.Equal(t, []string{"content.metadata[processor]"}, violationFields(t, err))
+
+		// each stage grows the data by 4/3 so the output outgrows the max data size
+		spec := strings.TrimSuffix(strings.Repeat("base64-encode|", format.MaxPipelineStages), "|")
+		_, err = ping(spec, strings.Repeat("a", DefaultLimits.MaxDataSize/2))
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		assert.Contains(t, status.Convert(err).Message(), "larger than")
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		stats, err := c.GetStats(ctx, &pb.GetStatsRequest{})
+		require.NoError(t, err)
+
+		_, err = ping("base64-decode", "!")
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		assert.Contains(t, status.Convert(err).Message(), "invalid base64 data")
+
+		// decoded data which can't be returned as a string
+		_, err = ping("base64-decode", "/w==")
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		after, err := c.GetStats(ctx, &pb.GetStatsRequest{})
+		require.NoError(t, err)
+		assert.Equal(t, stats.MessageCount, after.MessageCount, "failed messages are not recorded")
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		stream, err := c.Stream(ctx)
+		require.NoError(t, err)
+		req := getTestRequest()
+		req.Content.Metadata[ProcessorKey] = "json"
+		req.Content.Data = []byte("{")
+		require.NoError(t, stream.Send(req))
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, pb.PingResponse_Error, res.Result)
+		assert.Contains(t, res.ErrorMessage, "invalid JSON data")
+		require.NoError(t, stream.CloseSend())
+	})
+}
+
+func TestWithProcessors(t *testing.T) {
+	r := format.NewRegistry()
+	require.NoError(t, r.Register("lower", "Lowercased", format.ProcessorFunc(func(data []byte) ([]byte, error) {
+		return bytes.ToLower(data), nil
+	})))
+	srv := NewPingService(nil, WithProcessors(r))
+
+	req := getTestRequest()
+	req.Content.Data = []byte("TEST")
+	req.Content.Metadata[ProcessorKey] = "lower"
+	res, err := srv.processReq(context.Background(), pingMethodName, req)
+	require.NoError(t, err)
+	assert.Equal(t, "Lowercased: test", res.Detail)
+}
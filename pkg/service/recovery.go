@@ -0,0 +1,41 @@
+package service
+
+import (
+	"context"
+	"runtime/debug"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// unaryRecoveryInterceptor converts handler panics into Internal errors
+func (s *PingService) unaryRecoveryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (res interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = s.recovered(info.FullMethod, r)
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// streamRecoveryInterceptor converts handler panics into Internal errors
+func (s *PingService) streamRecoveryInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = s.recovered(info.FullMethod, r)
+		}
+	}()
+	return handler(srv, ss)
+}
+
+func (s *PingService) recovered(method string, r interface{}) error {
+	s.metrics.panics.WithLabelValues(method).Inc()
+	log.WithFields(log.Fields{
+		"method": method,
+		"panic":  r,
+		"stack":  string(debug.Stack()),
+	}).Error("recovered from panic")
+	return status.Error(codes.Internal, "internal server error")
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestRecovery(t *testing.T) {
+	unaryPanic := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if req.(*pb.PingRequest).GetContent().GetId() == "panic" {
+			panic("unary test panic")
+		}
+		return handler(ctx, req)
+	}
+	streamPanic := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		panic("stream test panic")
+	}
+
+	lis := bufconn.Listen(1024 * 1024)
+	srv := NewPingService(lis, WithUnaryInterceptors(unaryPanic), WithStreamInterceptors(streamPanic))
+	go func() { _ = srv.Start(context.Background()) }()
+	t.Cleanup(func() { lis.Close() })
+	c := pb.NewServiceClient(dialConn(t, lis))
+	ctx := context.Background()
+
+	t.Run("unary panic", func(t *testing.T) {
+		req := getTestRequest()
+		req.Content.Id = "panic"
+		_, err := c.Ping(ctx, req)
+		assert.Equal(t, codes.Internal, status.Code(err))
+		assert.Equal(t, float64(1), testutil.ToFloat64(srv.metrics.panics.WithLabelValues(pingMethod)))
+	})
+
+	t.Run("stream panic", func(t *testing.T) {
+		stream, err := c.Stream(ctx)
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		assert.Equal(t, codes.Internal, status.Code(err))
+		assert.Equal(t, float64(1), testutil.ToFloat64(srv.metrics.panics.WithLabelValues(streamMethod)))
+	})
+
+	t.Run("nil content", func(t *testing.T) {
+		_, err := c.Ping(ctx, &pb.PingRequest{})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("server survives", func(t *testing.T) {
+		req := getTestRequest()
+		res, err := c.Ping(ctx, req)
+		require.NoError(t, err)
+		assert.Equal(t, req.Content.Id, res.MessageID)
+	})
+}
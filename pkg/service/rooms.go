@@ -0,0 +1,195 @@
+package service
+
+import (
+	"sync"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// RoomKey is the metadata key of the room a stream message is sent to. When
+	// set in the stream call metadata, the stream joins the room when opened.
+	RoomKey = "room"
+)
+
+// member is a stream which can join rooms. All the responses of the stream,
+// its own and the ones broadcast from the rooms, are queued in out and sent by
+// the stream handler so they are never sent concurrently.
+type member struct {
+	out      chan *pb.PingResponse
+	done     chan struct{}
+	doneOnce sync.Once
+	err      error
+	// recvErr is the error which ended receiving, set before out is closed
+	recvErr error
+	// rooms is only accessed by the goroutine receiving the stream messages
+	rooms map[string]struct{}
+}
+
+func newMember(bufferSize int) *member {
+	return &member{
+		out:   make(chan *pb.PingResponse, bufferSize),
+		done:  make(chan struct{}),
+		rooms: make(map[string]struct{}),
+	}
+}
+
+// stop ends the stream with the error and reports whether it was this call
+// which ended it
+func (m *member) stop(err error) (stopped bool) {
+	m.doneOnce.Do(func() {
+		m.err = err
+		close(m.done)
+		stopped = true
+	})
+	return stopped
+}
+
+// stopped reports whether the stream was ended
+func (m *member) stopped() bool {
+	select {
+	case <-m.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// send queues the response, waiting for room in the queue
+func (m *member) send(res *pb.PingResponse) error {
+	select {
+	case m.out <- res:
+		return nil
+	case <-m.done:
+		return m.err
+	}
+}
+
+// trySend queues the response without waiting and reports whether it fit
+func (m *member) trySend(res *pb.PingResponse) bool {
+	select {
+	case m.out <- res:
+		return true
+	default:
+		return false
+	}
+}
+
+// room orders the messages sent to it and holds its members
+type room struct {
+	lock    sync.Mutex
+	seq     int64
+	members map[*member]struct{}
+}
+
+// roomRegistry holds the rooms with at least one member. The registry lock is
+// always taken before the room lock.
+type roomRegistry struct {
+	lock       sync.Mutex
+	rooms      map[string]*room
+	bufferSize int
+	metrics    *serverMetrics
+}
+
+func newRoomRegistry(bufferSize int, m *serverMetrics) *roomRegistry {
+	if bufferSize <= 0 {
+		bufferSize = DefaultSubscriberBuffer
+	}
+	return &roomRegistry{
+		rooms:      make(map[string]*room),
+		bufferSize: bufferSize,
+		metrics:    m,
+	}
+}
+
+// lockRoom returns the locked room, creating it if needed
+func (r *roomRegistry) lockRoom(name string) *room {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	rm, ok := r.rooms[name]
+	if !ok {
+		rm = &room{members: make(map[*member]struct{})}
+		r.rooms[name] = rm
+		r.metrics.rooms.Inc()
+	}
+	rm.lock.Lock()
+	return rm
+}
+
+// join adds the member to the room
+func (r *roomRegistry) join(name string, m *member) {
+	rm := r.lockRoom(name)
+	defer rm.lock.Unlock()
+	rm.members[m] = struct{}{}
+	m.rooms[name] = struct{}{}
+}
+
+// leaveAll removes the member from all its rooms, removing the rooms left empty
+func (r *roomRegistry) leaveAll(m *member) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for name := range m.rooms {
+		delete(m.rooms, name)
+		rm, ok := r.rooms[name]
+		if !ok {
+			continue
+		}
+		rm.lock.Lock()
+		delete(rm.members, m)
+		if len(rm.members) == 0 {
+			delete(r.rooms, name)
+			r.metrics.rooms.Dec()
+		}
+		rm.lock.Unlock()
+	}
+}
+
+// publish assigns the next room sequence to the message, joining the sender
+// to the room if needed. The ack is queued to the sender and the broadcast to
+// all the other members, so every member sees the messages of the room in the
+// same order. Members too slow to keep up are disconnected rather than having
+// messages dropped, which would break that order.
+func (r *roomRegistry) publish(name string, sender *member, ack, broadcast *pb.PingResponse) error {
+	if sender.stopped() {
+		return sender.err
+	}
+
+	rm := r.lockRoom(name)
+	defer rm.lock.Unlock()
+	rm.members[sender] = struct{}{}
+	sender.rooms[name] = struct{}{}
+
+	rm.seq++
+	ack.Room, ack.Sequence = name, rm.seq
+	broadcast.Room, broadcast.Sequence = name, rm.seq
+
+	for m := range rm.members {
+		res := broadcast
+		if m == sender {
+			res = ack
+		}
+		if m.trySend(res) {
+			continue
+		}
+		delete(rm.members, m)
+		if m.stop(status.Errorf(codes.ResourceExhausted,
+			"stream buffer of %d responses is full", r.bufferSize)) {
+			r.metrics.roomDisconnects.Inc()
+		}
+	}
+	return nil
+}
+
+// members returns the number of members in the room
+func (r *roomRegistry) members(name string) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if rm, ok := r.rooms[name]; ok {
+		rm.lock.Lock()
+		defer rm.lock.Unlock()
+		return len(rm.members)
+	}
+	return 0
+}
@@ -0,0 +1,208 @@
+package service
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestStreamRooms(t *testing.T) {
+	lis := bufconn.Listen(1024 * 1024)
+	srv := NewPingService(lis)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { _ = srv.Start(ctx) }()
+	t.Cleanup(cancel)
+	c := pb.NewServiceClient(dialConn(t, lis))
+
+	a := joinRoom(t, c, "a", "")
+	b := joinRoom(t, c, "b", "r1")
+	other := joinRoom(t, c, "other", "")
+	require.Eventually(t, func() bool {
+		return srv.rooms.members("r1") == 1
+	}, time.Second, 10*time.Millisecond, "stream joins the room from call metadata")
+
+	req := roomRequest("r1")
+	require.NoError(t, a.Send(req))
+	ack, err := a.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, pb.PingResponse_Success, ack.Result)
+	assert.Equal(t, "r1", ack.Room)
+	assert.Equal(t, int64(1), ack.Sequence)
+	assert.Empty(t, ack.SenderID, "the sender gets its own response")
+	assert.Nil(t, ack.Content)
+	assert.Equal(t, 2, srv.rooms.members("r1"), "stream joins the room it sends to")
+
+	res, err := b.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, req.Content.Id, res.MessageID)
+	assert.Equal(t, "r1", res.Room)
+	assert.Equal(t, int64(1), res.Sequence)
+	assert.Equal(t, "a", res.SenderID)
+	assert.True(t, proto.Equal(req.Content, res.Content))
+	assert.Equal(t, ack.Detail, res.Detail)
+
+	t.Run("duplicate", func(t *testing.T) {
+		require.NoError(t, a.Send(req))
+		res, err := a.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, ack.MessageCount, res.MessageCount)
+		assert.Equal(t, "r1", res.Room, "duplicates get the original ack")
+		assert.Equal(t, ack.Sequence, res.Sequence)
+
+		// the next broadcast follows the first one without the duplicate
+		next := roomRequest("r1")
+		require.NoError(t, b.Send(next))
+		res, err = b.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), res.Sequence)
+		res, err = a.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, next.Content.Id, res.MessageID)
+		assert.Equal(t, "b", res.SenderID)
+	})
+
+	t.Run("no room", func(t *testing.T) {
+		require.NoError(t, other.Send(getTestRequest()))
+		res, err := other.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, pb.PingResponse_Success, res.Result)
+		assert.Empty(t, res.Room)
+		assert.Zero(t, res.Sequence)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		require.NoError(t, a.Send(&pb.PingRequest{Content: &pb.Content{
+			Metadata: map[string]string{RoomKey: "r1"},
+		}}))
+		res, err := a.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, pb.PingResponse_Error, res.Result)
+		assert.Empty(t, res.Room, "invalid messages are not broadcast")
+	})
+
+	t.Run("leave", func(t *testing.T) {
+		assert.Equal(t, float64(1), testutil.ToFloat64(srv.metrics.rooms))
+		for _, stream := range []pb.Service_StreamClient{a, b} {
+			require.NoError(t, stream.CloseSend())
+			_, err := stream.Recv()
+			assert.Equal(t, io.EOF, err)
+		}
+		require.Eventually(t, func() bool {
+			return srv.rooms.members("r1") == 0
+		}, time.Second, 10*time.Millisecond)
+		assert.Equal(t, float64(0), testutil.ToFloat64(srv.metrics.rooms), "empty rooms are removed")
+	})
+}
+
+func TestStreamRoomOrder(t *testing.T) {
+	lis := bufconn.Listen(1024 * 1024)
+	srv := NewPingService(lis)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { _ = srv.Start(ctx) }()
+	t.Cleanup(cancel)
+	c := pb.NewServiceClient(dialConn(t, lis))
+
+	const senders, messages = 4, 20
+	listener := joinRoom(t, c, "listener", "r1")
+	streams := make([]pb.Service_StreamClient, senders)
+	for i := range streams {
+		streams[i] = joinRoom(t, c, "sender", "r1")
+	}
+	require.Eventually(t, func() bool {
+		return srv.rooms.members("r1") == senders+1
+	}, time.Second, 10*time.Millisecond)
+
+	// every stream in the room sees the messages in the same order
+	var wg sync.WaitGroup
+	seqs := make([][]int64, senders)
+	ids := make([][]string, senders)
+	for i, stream := range streams {
+		wg.Add(1)
+		go func(i int, stream pb.Service_StreamClient) {
+			defer wg.Done()
+			go func() {
+				for j := 0; j < messages; j++ {
+					if !assert.NoError(t, stream.Send(roomRequest("r1"))) {
+						return
+					}
+				}
+			}()
+			for j := 0; j < senders*messages; j++ {
+				res, err := stream.Recv()
+				if !assert.NoError(t, err) {
+					return
+				}
+				seqs[i] = append(seqs[i], res.Sequence)
+				ids[i] = append(ids[i], res.MessageID)
+			}
+		}(i, stream)
+	}
+
+	var listened []string
+	for j := 0; j < senders*messages; j++ {
+		res, err := listener.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, int64(j+1), res.Sequence)
+		listened = append(listened, res.MessageID)
+	}
+	wg.Wait()
+
+	for i := range streams {
+		for j, seq := range seqs[i] {
+			assert.Equal(t, int64(j+1), seq)
+		}
+		assert.Equal(t, listened, ids[i])
+	}
+}
+
+func TestRoomSlowMembers(t *testing.T) {
+	m := NewPingService(nil).metrics
+	r := newRoomRegistry(1, m)
+	sender, slow := newMember(1), newMember(1)
+	r.join("r1", slow)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, r.publish("r1", sender, &pb.PingResponse{}, &pb.PingResponse{}))
+		<-sender.out
+	}
+
+	<-slow.done
+	assert.Equal(t, codes.ResourceExhausted, status.Code(slow.err))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.roomDisconnects), "member is disconnected once")
+	assert.Equal(t, 1, r.members("r1"))
+	assert.Equal(t, int64(1), (<-slow.out).Sequence, "queued responses stay in order")
+
+	sender.stop(status.Error(codes.Canceled, "test"))
+	err := r.publish("r1", sender, &pb.PingResponse{}, &pb.PingResponse{})
+	assert.Equal(t, codes.Canceled, status.Code(err), "stopped members do not publish")
+}
+
+// joinRoom opens a stream for the client, joining the room when set
+func joinRoom(t *testing.T, c pb.ServiceClient, clientID, room string) pb.Service_StreamClient {
+	t.Helper()
+	ctx := metadata.AppendToOutgoingContext(context.Background(), ClientIDKey, clientID)
+	if room != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, RoomKey, room)
+	}
+	stream, err := c.Stream(ctx)
+	require.NoError(t, err)
+	return stream
+}
+
+func roomRequest(room string) *pb.PingRequest {
+	req := getTestRequest()
+	req.Content.Metadata[RoomKey] = room
+	return req
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	t.Run("in-flight stream completes", func(t *testing.T) {
+		lis, cancel, done := startShutdownServer(t, 3*time.Second)
+		stream := openTestStream(t, lis)
+
+		cancel()
+		select {
+		case <-done:
+			t.Fatal("server stopped with stream in flight")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		require.NoError(t, stream.Send(getTestRequest()))
+		_, err := stream.Recv()
+		require.NoError(t, err)
+		require.NoError(t, stream.CloseSend())
+		_, err = stream.Recv()
+		assert.Equal(t, io.EOF, err)
+
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(3 * time.Second):
+			t.Fatal("server did not stop after stream completed")
+		}
+	})
+
+	t.Run("drain timeout stops server", func(t *testing.T) {
+		lis, cancel, done := startShutdownServer(t, 100*time.Millisecond)
+		stream := openTestStream(t, lis)
+
+		cancel()
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(3 * time.Second):
+			t.Fatal("server did not stop after drain timeout")
+		}
+
+		_, err := stream.Recv()
+		assert.Error(t, err)
+	})
+
+	t.Run("health watch ends", func(t *testing.T) {
+		lis, cancel, done := startShutdownServer(t, 3*time.Second)
+		ctx, watchCancel := context.WithCancel(context.Background())
+		t.Cleanup(watchCancel)
+		watch, err := healthpb.NewHealthClient(dialConn(t, lis)).Watch(ctx, &healthpb.HealthCheckRequest{})
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			res, err := watch.Recv()
+			return err == nil && res.Status == healthpb.HealthCheckResponse_SERVING
+		}, time.Second, time.Millisecond)
+
+		start := time.Now()
+		cancel()
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+			assert.Less(t, time.Since(start), time.Second, "the watch does not block the drain")
+		case <-time.After(3 * time.Second):
+			t.Fatal("server did not stop with health watch open")
+		}
+
+		res, err := watch.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, res.Status)
+		_, err = watch.Recv()
+		assert.Equal(t, io.EOF, err)
+	})
+
+	t.Run("http server", func(t *testing.T) {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		srv := NewPingService(lis, WithDrainTimeout(time.Second))
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() { _ = srv.Start(ctx) }()
+
+		httpAddr := freeAddr(t)
+		done := make(chan error, 1)
+		go func() { done <- srv.StartHTTP(ctx, httpAddr) }()
+		require.Eventually(t, func() bool {
+			code, _ := getHealth(t, "http://"+httpAddr+"/readyz")
+			return code != 0
+		}, 3*time.Second, 20*time.Millisecond)
+
+		cancel()
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(3 * time.Second):
+			t.Fatal("http server did not stop")
+		}
+	})
+}
+
+func startShutdownServer(t *testing.T, drain time.Duration) (*bufconn.Listener, context.CancelFunc, <-chan error) {
+	t.Helper()
+	lis := bufconn.Listen(1024 * 1024)
+	srv := NewPingService(lis, WithDrainTimeout(drain))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.Start(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		lis.Close()
+	})
+	return lis, cancel, done
+}
+
+func openTestStream(t *testing.T, lis *bufconn.Listener) pb.Service_StreamClient {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	stream, err := pb.NewServiceClient(dialConn(t, lis)).Stream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(getTestRequest()))
+	_, err = stream.Recv()
+	require.NoError(t, err)
+	return stream
+}
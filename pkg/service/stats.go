@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// UnknownClientID is the client ID messages without one are counted under
+	UnknownClientID = "unknown"
+
+	pingMethodName   = "Ping"
+	streamMethodName = "Stream"
+)
+
+// GetStats returns the message counters of each client
+func (s *PingService) GetStats(ctx context.Context, req *pb.GetStatsRequest) (*pb.GetStatsResponse, error) {
+	list, err := s.store.ListStats()
+	if err != nil {
+		log.WithError(err).Error("error listing stats")
+		return nil, status.Error(codes.Internal, "error listing stats")
+	}
+
+	res := &pb.GetStatsResponse{
+		Clients: make([]*pb.ClientStats, 0, len(list)),
+	}
+	for _, cs := range list {
+		res.MessageCount += cs.MessageCount
+		if req.GetClientID() == "" || req.GetClientID() == cs.ClientID {
+			res.Clients = append(res.Clients, cs)
+		}
+	}
+	return res, nil
+}
+
+// recordMessage counts the processed message against its client and saves it
+// in the history. The response count is set to the updated client count.
+func (s *PingService) recordMessage(msg *pb.Message, req *pb.PingRequest, res *pb.PingResponse) error {
+	err := s.store.UpdateStats(msg.ClientID, func(cs *pb.ClientStats) {
+		res.MessageCount = cs.MessageCount + 1
+		addStats(cs, msg.Method, proto.Size(req), proto.Size(res), msg.Processed)
+	})
+	if err != nil {
+		return errors.Wrap(err, "error updating stats")
+	}
+	if err := s.store.SaveMessage(msg); err != nil {
+		return errors.Wrap(err, "error saving message")
+	}
+	return nil
+}
+
+// addStats counts a single message in the client counters
+func addStats(cs *pb.ClientStats, method string, bytesIn, bytesOut int, processed int64) {
+	if cs.FirstSeen == 0 {
+		cs.FirstSeen = processed
+	}
+	cs.LastSeen = processed
+	cs.MessageCount++
+	cs.BytesIn += int64(bytesIn)
+	cs.BytesOut += int64(bytesOut)
+
+	if cs.Methods == nil {
+		cs.Methods = make(map[string]*pb.MethodStats)
+	}
+	m, ok := cs.Methods[method]
+	if !ok {
+		m = &pb.MethodStats{}
+		cs.Methods[method] = m
+	}
+	m.MessageCount++
+	m.BytesIn += int64(bytesIn)
+	m.BytesOut += int64(bytesOut)
+}
+
+// clientCount returns the number of messages processed for the client
+func (s *PingService) clientCount(clientID string) int64 {
+	cs, err := s.store.GetStats(clientID)
+	if err != nil {
+		log.WithError(err).Errorf("error reading stats of client: %s", clientID)
+	}
+	return cs.GetMessageCount()
+}
+
+// getMessageCount returns the number of messages processed across all clients
+func (s *PingService) getMessageCount() int64 {
+	list, err := s.store.ListStats()
+	if err != nil {
+		log.WithError(err).Error("error listing stats")
+		return 0
+	}
+	var count int64
+	for _, cs := range list {
+		count += cs.MessageCount
+	}
+	return count
+}
+
+// requestClientID returns the client ID from the call metadata, falling back
+// on the one in the request content metadata
+func requestClientID(ctx context.Context, req *pb.PingRequest) string {
+	if id := metadataClientID(ctx); id != "" {
+		return id
+	}
+	if id := contentClientID(req); id != "" {
+		return id
+	}
+	return UnknownClientID
+}
@@ -0,0 +1,163 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"github.com/mchmarny/grpc-lab/pkg/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestClientStats(t *testing.T) {
+	lis := startBufconnServer(t)
+	c := pb.NewServiceClient(dialConn(t, lis))
+	ctxA := metadata.AppendToOutgoingContext(context.Background(), ClientIDKey, "a")
+	ctxB := metadata.AppendToOutgoingContext(context.Background(), ClientIDKey, "b")
+
+	var bytesIn, bytesOut int64
+	for i := 1; i <= 3; i++ {
+		req := getTestRequest()
+		res, err := c.Ping(ctxA, req)
+		require.NoError(t, err)
+		assert.Equal(t, int64(i), res.MessageCount)
+		bytesIn += int64(proto.Size(req))
+		bytesOut += int64(proto.Size(res))
+	}
+
+	res, err := c.Ping(ctxB, getTestRequest())
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), res.MessageCount, "counts are per client")
+
+	stream, err := c.Stream(ctxB)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(getTestRequest()))
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), res.MessageCount)
+	require.NoError(t, stream.CloseSend())
+
+	invalid := getTestRequest()
+	invalid.Content.Id = ""
+	_, err = c.Ping(ctxA, invalid)
+	require.Error(t, err)
+
+	stats, err := c.GetStats(context.Background(), &pb.GetStatsRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), stats.MessageCount)
+	require.Len(t, stats.Clients, 2)
+
+	a := stats.Clients[0]
+	assert.Equal(t, "a", a.ClientID)
+	assert.Equal(t, int64(3), a.MessageCount, "invalid messages are not counted")
+	assert.Equal(t, bytesIn, a.BytesIn)
+	assert.Equal(t, bytesOut, a.BytesOut)
+	assert.LessOrEqual(t, a.FirstSeen, a.LastSeen)
+	assert.Equal(t, &pb.MethodStats{MessageCount: 3, BytesIn: bytesIn, BytesOut: bytesOut}, a.Methods[pingMethodName])
+
+	b := stats.Clients[1]
+	assert.Equal(t, "b", b.ClientID)
+	assert.Equal(t, int64(2), b.MessageCount)
+	assert.Equal(t, int64(1), b.Methods[pingMethodName].MessageCount)
+	assert.Equal(t, int64(1), b.Methods[streamMethodName].MessageCount)
+
+	t.Run("filter", func(t *testing.T) {
+		stats, err := c.GetStats(context.Background(), &pb.GetStatsRequest{ClientID: "b"})
+		require.NoError(t, err)
+		require.Len(t, stats.Clients, 1)
+		assert.Equal(t, "b", stats.Clients[0].ClientID)
+	})
+}
+
+func TestClientStatsFallback(t *testing.T) {
+	srv := NewPingService(nil)
+	ctx := context.Background()
+
+	_, err := srv.processReq(ctx, pingMethodName, getTestRequest())
+	require.NoError(t, err)
+
+	req := getTestRequest()
+	delete(req.Content.Metadata, ClientIDKey)
+	_, err = srv.processReq(ctx, pingMethodName, req)
+	require.NoError(t, err)
+
+	stats, err := srv.GetStats(ctx, &pb.GetStatsRequest{})
+	require.NoError(t, err)
+	require.Len(t, stats.Clients, 2)
+	assert.Equal(t, "test", stats.Clients[0].ClientID, "content metadata is used without call metadata")
+	assert.Equal(t, UnknownClientID, stats.Clients[1].ClientID)
+}
+
+func TestStatsGateway(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := NewPingService(lis)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { _ = srv.Start(ctx) }()
+	t.Cleanup(cancel)
+
+	httpAddr := freeAddr(t)
+	go func() { _ = srv.StartHTTP(ctx, httpAddr) }()
+
+	_, err = srv.processReq(ctx, pingMethodName, getTestRequest())
+	require.NoError(t, err)
+
+	var resp *http.Response
+	require.Eventually(t, func() bool {
+		resp, err = http.Get("http://" + httpAddr + "/v1/stats?clientID=test")
+		return err == nil
+	}, 3*time.Second, 20*time.Millisecond)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var out struct {
+		Clients []struct {
+			ClientID     string `json:"clientID"`
+			MessageCount string `json:"messageCount"`
+		} `json:"clients"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&out))
+	require.Len(t, out.Clients, 1)
+	assert.Equal(t, "test", out.Clients[0].ClientID)
+	assert.Equal(t, "1", out.Clients[0].MessageCount)
+}
+
+func TestStatsPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ping.db")
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(ClientIDKey, "a"))
+
+	st, err := store.NewBoltStore(path, store.DefaultHistorySize)
+	require.NoError(t, err)
+	srv := NewPingService(nil, WithStore(st))
+	for i := 0; i < 2; i++ {
+		_, err := srv.processReq(ctx, pingMethodName, getTestRequest())
+		require.NoError(t, err)
+	}
+	require.NoError(t, st.Close())
+
+	st, err = store.NewBoltStore(path, store.DefaultHistorySize)
+	require.NoError(t, err)
+	defer st.Close()
+	srv = NewPingService(nil, WithStore(st))
+
+	req := getTestRequest()
+	res, err := srv.processReq(ctx, pingMethodName, req)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), res.MessageCount, "count continues after restart")
+	assert.Equal(t, int64(3), srv.getMessageCount())
+
+	page, err := st.ListMessages(&store.MessageQuery{})
+	require.NoError(t, err)
+	require.Len(t, page.Messages, 3)
+	assert.Equal(t, "a", page.Messages[0].ClientID)
+	assert.Equal(t, pingMethodName, page.Messages[0].Method)
+	assert.Equal(t, req.Content.Id, page.Messages[0].Content.Id)
+}
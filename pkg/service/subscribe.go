@@ -0,0 +1,174 @@
+package service
+
+import (
+	"sync"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// SlowConsumerPolicy defines what happens when a subscriber buffer is full
+type SlowConsumerPolicy string
+
+const (
+	// DropPolicy drops the responses which do not fit in the subscriber buffer
+	DropPolicy SlowConsumerPolicy = "drop"
+	// DisconnectPolicy ends the subscription once its buffer is full
+	DisconnectPolicy SlowConsumerPolicy = "disconnect"
+
+	// DefaultSubscriberBuffer is the default number of responses buffered per subscriber
+	DefaultSubscriberBuffer = 100
+)
+
+// subscriber receives the responses of the matching messages until done is closed
+type subscriber struct {
+	ch       chan *pb.PingResponse
+	matches  func(*pb.Message) bool
+	done     chan struct{}
+	doneOnce sync.Once
+	err      error
+}
+
+// stop ends the subscription with the error returned to the subscriber and
+// reports whether it was this call which ended it
+func (s *subscriber) stop(err error) (stopped bool) {
+	s.doneOnce.Do(func() {
+		s.err = err
+		close(s.done)
+		stopped = true
+	})
+	return stopped
+}
+
+// broker fans the processed responses out to all the subscribers
+type broker struct {
+	lock       sync.RWMutex
+	subs       map[*subscriber]struct{}
+	closed     bool
+	bufferSize int
+	policy     SlowConsumerPolicy
+	metrics    *serverMetrics
+}
+
+func newBroker(bufferSize int, policy SlowConsumerPolicy, m *serverMetrics) *broker {
+	if bufferSize <= 0 {
+		bufferSize = DefaultSubscriberBuffer
+	}
+	if policy != DisconnectPolicy {
+		policy = DropPolicy
+	}
+	return &broker{
+		subs:       make(map[*subscriber]struct{}),
+		bufferSize: bufferSize,
+		policy:     policy,
+		metrics:    m,
+	}
+}
+
+// subscribe registers a subscriber for the messages matched by the func
+func (b *broker) subscribe(matches func(*pb.Message) bool) *subscriber {
+	sub := &subscriber{
+		ch:      make(chan *pb.PingResponse, b.bufferSize),
+		matches: matches,
+		done:    make(chan struct{}),
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		sub.stop(status.Error(codes.Unavailable, "server is shutting down"))
+		return sub
+	}
+	b.subs[sub] = struct{}{}
+	b.metrics.subscribers.Inc()
+	return sub
+}
+
+// unsubscribe removes the subscriber
+func (b *broker) unsubscribe(sub *subscriber) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, ok := b.subs[sub]; ok {
+		delete(b.subs, sub)
+		b.metrics.subscribers.Dec()
+	}
+}
+
+// publish sends the response to the subscribers matching the message without
+// blocking. When a subscriber buffer is full the response is either dropped
+// or the subscriber is disconnected, depending on the policy.
+func (b *broker) publish(msg *pb.Message, res *pb.PingResponse) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	for sub := range b.subs {
+		if !sub.matches(msg) {
+			continue
+		}
+		select {
+		case sub.ch <- res:
+		default:
+			if b.policy == DisconnectPolicy {
+				if sub.stop(status.Errorf(codes.ResourceExhausted,
+					"subscriber buffer of %d responses is full", b.bufferSize)) {
+					b.metrics.subscriberDisconnects.Inc()
+				}
+				continue
+			}
+			b.metrics.subscriberDrops.Inc()
+		}
+	}
+}
+
+// close ends all the subscriptions and rejects new ones
+func (b *broker) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closed = true
+	for sub := range b.subs {
+		sub.stop(status.Error(codes.Unavailable, "server is shutting down"))
+	}
+}
+
+// count returns the number of subscribers
+func (b *broker) count() int {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return len(b.subs)
+}
+
+// Subscribe streams the responses of the messages as they are processed
+func (s *PingService) Subscribe(req *pb.SubscribeRequest, stream pb.Service_SubscribeServer) error {
+	if req.GetMetadataValue() != "" && req.GetMetadataKey() == "" {
+		return invalidArgument([]*errdetails.BadRequest_FieldViolation{
+			violation("metadataKey", "is required when metadataValue is set"),
+		})
+	}
+
+	sub := s.broker.subscribe(messageFilter(req.GetClientID(), req.GetMetadataKey(), req.GetMetadataValue()))
+	defer s.broker.unsubscribe(sub)
+
+	// the header lets the subscriber know the subscription is active
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return errors.Wrap(err, "error sending subscribe header")
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-sub.done:
+			log.WithError(sub.err).Debug("subscription ended")
+			return sub.err
+		case res := <-sub.ch:
+			if err := stream.Send(res); err != nil {
+				return errors.Wrap(err, "error sending subscribe response")
+			}
+		}
+	}
+}
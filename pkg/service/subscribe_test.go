@@ -0,0 +1,159 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestSubscribe(t *testing.T) {
+	lis := bufconn.Listen(1024 * 1024)
+	srv := NewPingService(lis)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { _ = srv.Start(ctx) }()
+	t.Cleanup(cancel)
+	c := pb.NewServiceClient(dialConn(t, lis))
+
+	all := subscribe(t, c, &pb.SubscribeRequest{})
+	onlyA := subscribe(t, c, &pb.SubscribeRequest{ClientID: "a"})
+	tagged := subscribe(t, c, &pb.SubscribeRequest{MetadataKey: "tag", MetadataValue: "x"})
+	assert.Equal(t, 3, srv.broker.count())
+	assert.Equal(t, float64(3), testutil.ToFloat64(srv.metrics.subscribers))
+
+	ids := make([]string, 0)
+	for _, clientID := range []string{"a", "b", "a"} {
+		req := getTestRequest()
+		if clientID == "b" {
+			req.Content.Metadata["tag"] = "x"
+		}
+		ids = append(ids, req.Content.Id)
+		_, err := c.Ping(metadata.AppendToOutgoingContext(ctx, ClientIDKey, clientID), req)
+		require.NoError(t, err)
+	}
+
+	// invalid messages and duplicates are not published
+	_, err := c.Ping(ctx, &pb.PingRequest{Content: &pb.Content{Id: "invalid"}})
+	require.Error(t, err)
+	dup := getTestRequest()
+	dup.Content.Id = ids[0]
+	_, err = c.Ping(metadata.AppendToOutgoingContext(ctx, ClientIDKey, "a"), dup)
+	require.NoError(t, err)
+
+	assert.Equal(t, ids, receiveIDs(t, all, 3))
+	assert.Equal(t, []string{ids[0], ids[2]}, receiveIDs(t, onlyA, 2))
+	assert.Equal(t, []string{ids[1]}, receiveIDs(t, tagged, 1))
+
+	t.Run("invalid", func(t *testing.T) {
+		stream, err := c.Subscribe(ctx, &pb.SubscribeRequest{MetadataValue: "x"})
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("unsubscribe", func(t *testing.T) {
+		subCtx, subCancel := context.WithCancel(ctx)
+		stream, err := c.Subscribe(subCtx, &pb.SubscribeRequest{})
+		require.NoError(t, err)
+		_, err = stream.Header()
+		require.NoError(t, err)
+		assert.Equal(t, 4, srv.broker.count())
+
+		subCancel()
+		require.Eventually(t, func() bool {
+			return srv.broker.count() == 3
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		cancel()
+		_, err := all.Recv()
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	})
+}
+
+func TestBrokerSlowConsumers(t *testing.T) {
+	msg := &pb.Message{ClientID: "a"}
+	all := func(*pb.Message) bool { return true }
+
+	t.Run("drop", func(t *testing.T) {
+		m := NewPingService(nil).metrics
+		b := newBroker(2, DropPolicy, m)
+		slow := b.subscribe(all)
+		fast := b.subscribe(all)
+
+		for i := 1; i <= 4; i++ {
+			b.publish(msg, &pb.PingResponse{MessageCount: int64(i)})
+			<-fast.ch
+		}
+
+		assert.Equal(t, int64(1), (<-slow.ch).MessageCount)
+		assert.Equal(t, int64(2), (<-slow.ch).MessageCount)
+		assert.Empty(t, slow.ch, "responses over the buffer are dropped")
+		assert.Equal(t, float64(2), testutil.ToFloat64(m.subscriberDrops))
+		select {
+		case <-slow.done:
+			t.Fatal("slow subscriber should not be disconnected")
+		default:
+		}
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		m := NewPingService(nil).metrics
+		b := newBroker(1, DisconnectPolicy, m)
+		slow := b.subscribe(all)
+		fast := b.subscribe(all)
+
+		for i := 1; i <= 3; i++ {
+			b.publish(msg, &pb.PingResponse{MessageCount: int64(i)})
+			<-fast.ch
+		}
+
+		<-slow.done
+		assert.Equal(t, codes.ResourceExhausted, status.Code(slow.err))
+		assert.Equal(t, float64(1), testutil.ToFloat64(m.subscriberDisconnects), "subscriber is disconnected once")
+		select {
+		case <-fast.done:
+			t.Fatal("fast subscriber should not be disconnected")
+		default:
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		b := newBroker(1, DropPolicy, NewPingService(nil).metrics)
+		b.close()
+		sub := b.subscribe(all)
+		<-sub.done
+		assert.Equal(t, codes.Unavailable, status.Code(sub.err))
+		assert.Equal(t, 0, b.count())
+	})
+}
+
+func subscribe(t *testing.T, c pb.ServiceClient, req *pb.SubscribeRequest) pb.Service_SubscribeClient {
+	t.Helper()
+	stream, err := c.Subscribe(context.Background(), req)
+	require.NoError(t, err)
+	// the header is sent once the subscription is active
+	_, err = stream.Header()
+	require.NoError(t, err)
+	return stream
+}
+
+func receiveIDs(t *testing.T, stream pb.Service_SubscribeClient, n int) []string {
+	t.Helper()
+	ids := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		ids = append(ids, res.MessageID)
+	}
+	return ids
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+
+	"github.com/mchmarny/grpc-lab/pkg/cert"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+func (s *PingService) tlsEnabled() bool {
+	return s.certFile != "" || s.keyFile != ""
+}
+
+// certReloader loads the server certificates once and returns the same
+// reloader on all subsequent calls so both the gRPC and HTTP servers share it.
+func (s *PingService) certReloader() (*cert.Reloader, error) {
+	s.tlsOnce.Do(func() {
+		s.certs, s.tlsErr = cert.NewReloader(s.certFile, s.keyFile, s.caFile, s.certReloadInterval)
+	})
+	return s.certs, s.tlsErr
+}
+
+// gatewayDialOptions returns the options used by the HTTP gateway to dial
+// the gRPC server over the loopback. Rather than trusting a CA and matching
+// the listener address to the certificate names, the gateway pins the
+// server's current certificate and, for mTLS, presents that same certificate.
+func (s *PingService) gatewayDialOptions() ([]grpc.DialOption, error) {
+	if !s.tlsEnabled() {
+		return []grpc.DialOption{grpc.WithInsecure()}, nil
+	}
+
+	certs, err := s.certReloader()
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading server certificates")
+	}
+
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// #nosec G402 peer is verified against the server's own certificate below
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) == 0 || !bytes.Equal(raw[0], certs.Certificate().Certificate[0]) {
+				return errors.New("gateway peer certificate does not match server certificate")
+			}
+			return nil
+		},
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return certs.Certificate(), nil
+		},
+	}
+	return []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(cfg))}, nil
+}
+
+// requireClientCert rejects the requests made without a client certificate,
+// the presented ones are verified during the handshake
+func requireClientCert(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
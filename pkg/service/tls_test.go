@@ -0,0 +1,324 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mchmarny/grpc-lab/pkg/cert"
+	"github.com/mchmarny/grpc-lab/pkg/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const testServerName = "localhost"
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+type testCerts struct {
+	dir        string
+	caFile     string
+	serverCert string
+	serverKey  string
+	clientCert string
+	clientKey  string
+	rogueCert  string
+	rogueKey   string
+}
+
+func TestTLS(t *testing.T) {
+	certs := generateTestCerts(t)
+	lis := startBufconnServer(t, WithTLS(certs.serverCert, certs.serverKey, ""))
+
+	t.Run("ping over TLS", func(t *testing.T) {
+		cfg, err := cert.NewClientConfig(certs.caFile, "", "", testServerName)
+		require.NoError(t, err)
+		c := dialBufconn(t, lis, client.WithTLS(cfg))
+
+		out, _, err := c.Ping(context.Background(), "test")
+		require.NoError(t, err)
+		assert.Equal(t, "Reversed: tset", out)
+	})
+
+	t.Run("ping with untrusted server cert", func(t *testing.T) {
+		cfg, err := cert.NewClientConfig("", "", "", testServerName)
+		require.NoError(t, err)
+		c := dialBufconn(t, lis, client.WithTLS(cfg))
+
+		_, _, err = c.Ping(context.Background(), "test")
+		assert.Error(t, err)
+	})
+
+	t.Run("ping in plaintext", func(t *testing.T) {
+		c := dialBufconn(t, lis)
+
+		_, _, err := c.Ping(context.Background(), "test")
+		assert.Error(t, err)
+	})
+}
+
+func TestMutualTLS(t *testing.T) {
+	certs := generateTestCerts(t)
+	lis := startBufconnServer(t, WithTLS(certs.serverCert, certs.serverKey, certs.caFile))
+
+	t.Run("ping with client cert", func(t *testing.T) {
+		cfg, err := cert.NewClientConfig(certs.caFile, certs.clientCert, certs.clientKey, testServerName)
+		require.NoError(t, err)
+		c := dialBufconn(t, lis, client.WithTLS(cfg))
+
+		_, _, err = c.Ping(context.Background(), "test")
+		assert.NoError(t, err)
+	})
+
+	t.Run("ping sans client cert", func(t *testing.T) {
+		cfg, err := cert.NewClientConfig(certs.caFile, "", "", testServerName)
+		require.NoError(t, err)
+		c := dialBufconn(t, lis, client.WithTLS(cfg))
+
+		_, _, err = c.Ping(context.Background(), "test")
+		assert.Error(t, err)
+	})
+
+	t.Run("ping with untrusted client cert", func(t *testing.T) {
+		cfg, err := cert.NewClientConfig(certs.caFile, certs.rogueCert, certs.rogueKey, testServerName)
+		require.NoError(t, err)
+		c := dialBufconn(t, lis, client.WithTLS(cfg))
+
+		_, _, err = c.Ping(context.Background(), "test")
+		assert.Error(t, err)
+	})
+}
+
+func TestGatewayMutualTLS(t *testing.T) {
+	certs := generateTestCerts(t)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := NewPingService(lis, WithTLS(certs.serverCert, certs.serverKey, certs.caFile))
+	go func() { _ = srv.Start(context.Background()) }()
+	t.Cleanup(func() { lis.Close() })
+
+	httpAddr := freeAddr(t)
+	go func() { _ = srv.StartHTTP(context.Background(), httpAddr) }()
+
+	cfg, err := cert.NewClientConfig(certs.caFile, certs.clientCert, certs.clientKey, testServerName)
+	require.NoError(t, err)
+	hc := &http.Client{
+		Timeout:   3 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: cfg},
+	}
+
+	body := []byte(`{"content": {"id": "id1", "data": "dGVzdA=="}}`)
+	var resp *http.Response
+	require.Eventually(t, func() bool {
+		resp, err = hc.Post("https://"+httpAddr+"/v1/ping", "application/json", bytes.NewReader(body))
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, string(b))
+	assert.Contains(t, string(b), "Reversed: tset")
+
+	// probes and scrapers connect without a client certificate
+	noCertCfg, err := cert.NewClientConfig(certs.caFile, "", "", testServerName)
+	require.NoError(t, err)
+	noCert := &http.Client{
+		Timeout:   3 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: noCertCfg},
+	}
+	for path, code := range map[string]int{
+		"/healthz": http.StatusOK,
+		"/readyz":  http.StatusOK,
+		"/metrics": http.StatusOK,
+		"/v1/ping": http.StatusUnauthorized,
+	} {
+		resp, err := noCert.Post("https://"+httpAddr+path, "application/json", bytes.NewReader(body))
+		require.NoError(t, err, path)
+		resp.Body.Close()
+		assert.Equal(t, code, resp.StatusCode, path)
+	}
+
+	rogueCfg, err := cert.NewClientConfig(certs.caFile, certs.rogueCert, certs.rogueKey, testServerName)
+	require.NoError(t, err)
+	rogue := &http.Client{
+		Timeout:   3 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: rogueCfg},
+	}
+	_, err = rogue.Get("https://" + httpAddr + "/healthz")
+	assert.Error(t, err, "presented client certificates are verified")
+}
+
+func TestCertReload(t *testing.T) {
+	certs := generateTestCerts(t)
+	lis := bufconn.Listen(1024 * 1024)
+	srv := NewPingService(lis,
+		WithTLS(certs.serverCert, certs.serverKey, ""),
+		WithCertReloadInterval(20*time.Millisecond),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { _ = srv.Start(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		lis.Close()
+	})
+
+	oldCfg, err := cert.NewClientConfig(certs.caFile, "", "", testServerName)
+	require.NoError(t, err)
+	existing := dialBufconn(t, lis, client.WithTLS(oldCfg))
+	_, _, err = existing.Ping(ctx, "before")
+	require.NoError(t, err)
+
+	// rotate server cert to one issued by a new CA
+	rotated := generateTestCerts(t)
+	replaceFile(t, rotated.serverCert, certs.serverCert)
+	replaceFile(t, rotated.serverKey, certs.serverKey)
+	require.Eventually(t, func() bool {
+		return srv.certs.ReloadCount() == 1
+	}, 3*time.Second, 20*time.Millisecond)
+
+	t.Run("existing connection", func(t *testing.T) {
+		_, _, err := existing.Ping(ctx, "after")
+		assert.NoError(t, err)
+	})
+
+	t.Run("new connection with new CA", func(t *testing.T) {
+		cfg, err := cert.NewClientConfig(rotated.caFile, "", "", testServerName)
+		require.NoError(t, err)
+		c := dialBufconn(t, lis, client.WithTLS(cfg))
+		_, _, err = c.Ping(ctx, "after")
+		assert.NoError(t, err)
+	})
+
+	t.Run("new connection with old CA", func(t *testing.T) {
+		c := dialBufconn(t, lis, client.WithTLS(oldCfg))
+		_, _, err := c.Ping(ctx, "after")
+		assert.Error(t, err)
+	})
+}
+
+func startBufconnServer(t *testing.T, opts ...Option) *bufconn.Listener {
+	t.Helper()
+	lis := bufconn.Listen(1024 * 1024)
+	srv := NewPingService(lis, opts...)
+	go func() { _ = srv.Start(context.Background()) }()
+	t.Cleanup(func() { lis.Close() })
+	return lis
+}
+
+func dialBufconn(t *testing.T, lis *bufconn.Listener, opts ...client.Option) *client.PingClient {
+	t.Helper()
+	dialer := func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	}
+	opts = append(opts, client.WithDialOptions(grpc.WithContextDialer(dialer)))
+	c, err := client.NewPingClient(context.Background(), "bufnet", "test", opts...)
+	require.NoError(t, err)
+	t.Cleanup(c.Close)
+	return c
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+	return lis.Addr().String()
+}
+
+func generateTestCerts(t *testing.T) *testCerts {
+	t.Helper()
+	c := &testCerts{dir: t.TempDir()}
+	c.caFile = filepath.Join(c.dir, "ca.pem")
+	c.serverCert, c.serverKey = filepath.Join(c.dir, "server.pem"), filepath.Join(c.dir, "server-key.pem")
+	c.clientCert, c.clientKey = filepath.Join(c.dir, "client.pem"), filepath.Join(c.dir, "client-key.pem")
+	c.rogueCert, c.rogueKey = filepath.Join(c.dir, "rogue.pem"), filepath.Join(c.dir, "rogue-key.pem")
+
+	ca := newTestCA(t, "test-ca")
+	writePEM(t, c.caFile, "CERTIFICATE", ca.cert.Raw)
+	ca.issue(t, "server", c.serverCert, c.serverKey)
+	ca.issue(t, "client", c.clientCert, c.clientKey)
+	newTestCA(t, "rogue-ca").issue(t, "rogue", c.rogueCert, c.rogueKey)
+	return c
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	crt, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: crt, key: key}
+}
+
+// issue creates a leaf certificate valid for both server and client auth
+func (ca *testCA) issue(t *testing.T, name, certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{testServerName},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+}
+
+// replaceFile swaps dst content with src the way secret mounts do, atomically
+func replaceFile(t *testing.T, src, dst string) {
+	t.Helper()
+	b, err := ioutil.ReadFile(src)
+	require.NoError(t, err)
+	tmp := dst + ".tmp"
+	require.NoError(t, ioutil.WriteFile(tmp, b, 0600))
+	require.NoError(t, os.Rename(tmp, dst))
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	b := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	require.NoError(t, ioutil.WriteFile(path, b, 0600))
+}
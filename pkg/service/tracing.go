@@ -0,0 +1,39 @@
+package service
+
+import (
+	"net/http"
+
+	"github.com/mchmarny/grpc-lab/pkg/tracing"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+)
+
+func (s *PingService) tracer() trace.Tracer {
+	return s.tracerProvider.Tracer(tracing.InstrumentationName)
+}
+
+func (s *PingService) otelOptions() []otelgrpc.Option {
+	return []otelgrpc.Option{
+		otelgrpc.WithTracerProvider(s.tracerProvider),
+		otelgrpc.WithPropagators(tracing.Propagator()),
+	}
+}
+
+// gatewayTracingDialOptions propagates the gateway request trace to the gRPC server
+func (s *PingService) gatewayTracingDialOptions() []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(otelgrpc.UnaryClientInterceptor(s.otelOptions()...)),
+		grpc.WithChainStreamInterceptor(otelgrpc.StreamClientInterceptor(s.otelOptions()...)),
+	}
+}
+
+// traceHTTP wraps the HTTP handler to extract the incoming trace context
+// and create a span for each request
+func (s *PingService) traceHTTP(h http.Handler, operation string) http.Handler {
+	return otelhttp.NewHandler(h, operation,
+		otelhttp.WithTracerProvider(s.tracerProvider),
+		otelhttp.WithPropagators(tracing.Propagator()),
+	)
+}
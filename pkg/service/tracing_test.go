@@ -0,0 +1,123 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mchmarny/grpc-lab/pkg/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+
+	lis := startBufconnServer(t, WithTracerProvider(tp))
+	c := dialBufconn(t, lis, client.WithTracerProvider(tp))
+
+	t.Run("ping", func(t *testing.T) {
+		_, _, err := c.Ping(context.Background(), "test")
+		require.NoError(t, err)
+
+		clientSpan := waitForSpan(t, sr, pingMethod[1:], trace.SpanKindClient)
+		serverSpan := waitForSpan(t, sr, pingMethod[1:], trace.SpanKindServer)
+		processSpan := waitForSpan(t, sr, "ping.process", trace.SpanKindInternal)
+
+		assert.Equal(t, clientSpan.SpanContext().SpanID(), serverSpan.Parent().SpanID())
+		assert.Equal(t, serverSpan.SpanContext().SpanID(), processSpan.Parent().SpanID())
+		assert.Equal(t, clientSpan.SpanContext().TraceID(), processSpan.SpanContext().TraceID())
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		_, err := c.StreamList(context.Background(), []string{"a", "b"})
+		require.NoError(t, err)
+
+		serverSpan := waitForSpan(t, sr, streamMethod[1:], trace.SpanKindServer)
+		var msgSpans []sdktrace.ReadOnlySpan
+		require.Eventually(t, func() bool {
+			msgSpans = findSpans(sr, "ping.stream.message", trace.SpanKindInternal)
+			return len(msgSpans) == 2
+		}, time.Second, 10*time.Millisecond)
+
+		for _, s := range msgSpans {
+			assert.Equal(t, serverSpan.SpanContext().SpanID(), s.Parent().SpanID())
+		}
+	})
+}
+
+func TestGatewayTracing(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := NewPingService(lis, WithTracerProvider(tp))
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { _ = srv.Start(ctx) }()
+	t.Cleanup(cancel)
+
+	httpAddr := freeAddr(t)
+	go func() { _ = srv.StartHTTP(ctx, httpAddr) }()
+
+	const (
+		traceID  = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentID = "00f067aa0ba902b7"
+	)
+	body := []byte(`{"content": {"id": "id1", "data": "dGVzdA=="}}`)
+	require.Eventually(t, func() bool {
+		req, err := http.NewRequest(http.MethodPost, "http://"+httpAddr+"/v1/ping", bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 3*time.Second, 20*time.Millisecond)
+
+	gatewaySpan := waitForSpan(t, sr, "gateway", trace.SpanKindServer)
+	gatewayClientSpan := waitForSpan(t, sr, pingMethod[1:], trace.SpanKindClient)
+	serverSpan := waitForSpan(t, sr, pingMethod[1:], trace.SpanKindServer)
+	processSpan := waitForSpan(t, sr, "ping.process", trace.SpanKindInternal)
+
+	assert.Equal(t, parentID, gatewaySpan.Parent().SpanID().String())
+	assert.Equal(t, gatewaySpan.SpanContext().SpanID(), gatewayClientSpan.Parent().SpanID())
+	assert.Equal(t, gatewayClientSpan.SpanContext().SpanID(), serverSpan.Parent().SpanID())
+	assert.Equal(t, serverSpan.SpanContext().SpanID(), processSpan.Parent().SpanID())
+	for _, s := range []sdktrace.ReadOnlySpan{gatewaySpan, gatewayClientSpan, serverSpan, processSpan} {
+		assert.Equal(t, traceID, s.SpanContext().TraceID().String())
+	}
+}
+
+func waitForSpan(t *testing.T, sr *tracetest.SpanRecorder, name string, kind trace.SpanKind) sdktrace.ReadOnlySpan {
+	t.Helper()
+	var span sdktrace.ReadOnlySpan
+	require.Eventually(t, func() bool {
+		spans := findSpans(sr, name, kind)
+		if len(spans) == 0 {
+			return false
+		}
+		span = spans[len(spans)-1]
+		return true
+	}, time.Second, 10*time.Millisecond, "span %s not found", name)
+	return span
+}
+
+func findSpans(sr *tracetest.SpanRecorder, name string, kind trace.SpanKind) []sdktrace.ReadOnlySpan {
+	list := make([]sdktrace.ReadOnlySpan, 0)
+	for _, s := range sr.Ended() {
+		if s.Name() == name && s.SpanKind() == kind {
+			list = append(list, s)
+		}
+	}
+	return list
+}
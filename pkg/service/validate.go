@@ -0,0 +1,148 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Limits defines the constraints requests are validated against
+type Limits struct {
+	// MaxDataSize is the max size of the content data in bytes
+	MaxDataSize int
+	// MaxMetadataEntries is the max number of content metadata entries
+	MaxMetadataEntries int
+	// MaxMetadataKeySize is the max size of each metadata key in bytes
+	MaxMetadataKeySize int
+	// MaxMetadataValueSize is the max size of each metadata value in bytes
+	MaxMetadataValueSize int
+	// MaxClockSkew is how far in the future the sent time can be
+	MaxClockSkew time.Duration
+}
+
+// DefaultLimits are the limits used unless overridden with WithLimits
+var DefaultLimits = Limits{
+	MaxDataSize:          64 * 1024,
+	MaxMetadataEntries:   32,
+	MaxMetadataKeySize:   64,
+	MaxMetadataValueSize: 1024,
+	MaxClockSkew:         5 * time.Second,
+}
+
+// rule represents a single validation check, returning any violations
+type rule func(req *pb.PingRequest, l Limits) []*errdetails.BadRequest_FieldViolation
+
+// pingRequestRules are the rules applied to each PingRequest, in order
+var pingRequestRules = []rule{
+	required("content.id", func(r *pb.PingRequest) bool { return r.GetContent().GetId() != "" }),
+	required("content.data", func(r *pb.PingRequest) bool { return len(r.GetContent().GetData()) > 0 }),
+	maxDataSize,
+	metadataLimits,
+	sentNotInFuture,
+}
+
+// validateRequest applies all the rules and returns InvalidArgument status
+// with BadRequest details listing every violation
+func validateRequest(req *pb.PingRequest, l Limits) error {
+	if req == nil {
+		return status.Error(codes.InvalidArgument, "request required")
+	}
+	if req.GetContent() == nil {
+		return invalidArgument([]*errdetails.BadRequest_FieldViolation{
+			violation("content", "is required"),
+		})
+	}
+
+	list := make([]*errdetails.BadRequest_FieldViolation, 0)
+	for _, r := range pingRequestRules {
+		list = append(list, r(req, l)...)
+	}
+	if len(list) == 0 {
+		return nil
+	}
+	return invalidArgument(list)
+}
+
+// invalidArgument returns InvalidArgument status with a message summarizing
+// the violations and the full list attached as BadRequest details
+func invalidArgument(list []*errdetails.BadRequest_FieldViolation) error {
+	msgs := make([]string, 0, len(list))
+	for _, v := range list {
+		msgs = append(msgs, fmt.Sprintf("%s %s", v.Field, v.Description))
+	}
+	st := status.New(codes.InvalidArgument, fmt.Sprintf("invalid request: %s", strings.Join(msgs, "; ")))
+	detailed, err := st.WithDetails(&errdetails.BadRequest{FieldViolations: list})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+func violation(field, desc string) *errdetails.BadRequest_FieldViolation {
+	return &errdetails.BadRequest_FieldViolation{Field: field, Description: desc}
+}
+
+func required(field string, isSet func(*pb.PingRequest) bool) rule {
+	return func(req *pb.PingRequest, _ Limits) []*errdetails.BadRequest_FieldViolation {
+		if isSet(req) {
+			return nil
+		}
+		return []*errdetails.BadRequest_FieldViolation{violation(field, "is required")}
+	}
+}
+
+func maxDataSize(req *pb.PingRequest, l Limits) []*errdetails.BadRequest_FieldViolation {
+	if size := len(req.GetContent().GetData()); size > l.MaxDataSize {
+		return []*errdetails.BadRequest_FieldViolation{
+			violation("content.data", fmt.Sprintf("size %d exceeds max of %d bytes", size, l.MaxDataSize)),
+		}
+	}
+	return nil
+}
+
+func metadataLimits(req *pb.PingRequest, l Limits) []*errdetails.BadRequest_FieldViolation {
+	md := req.GetContent().GetMetadata()
+	if len(md) > l.MaxMetadataEntries {
+		return []*errdetails.BadRequest_FieldViolation{
+			violation("content.metadata", fmt.Sprintf("%d entries exceed max of %d", len(md), l.MaxMetadataEntries)),
+		}
+	}
+
+	keys := make([]string, 0, len(md))
+	for k := range md {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	list := make([]*errdetails.BadRequest_FieldViolation, 0)
+	for _, k := range keys {
+		v := md[k]
+		field := fmt.Sprintf("content.metadata[%s]", k)
+		if k == "" {
+			list = append(list, violation(field, "key is required"))
+		}
+		if len(k) > l.MaxMetadataKeySize {
+			list = append(list, violation(field, fmt.Sprintf("key size %d exceeds max of %d bytes", len(k), l.MaxMetadataKeySize)))
+		}
+		if len(v) > l.MaxMetadataValueSize {
+			list = append(list, violation(field, fmt.Sprintf("value size %d exceeds max of %d bytes", len(v), l.MaxMetadataValueSize)))
+		}
+	}
+	return list
+}
+
+func sentNotInFuture(req *pb.PingRequest, l Limits) []*errdetails.BadRequest_FieldViolation {
+	sent := time.Unix(0, req.GetSent())
+	if sent.After(time.Now().Add(l.MaxClockSkew)) {
+		return []*errdetails.BadRequest_FieldViolation{
+			violation("sent", fmt.Sprintf("%s is in the future", sent.UTC().Format(time.RFC3339Nano))),
+		}
+	}
+	return nil
+}
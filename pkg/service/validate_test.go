@@ -0,0 +1,178 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestValidateRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*pb.PingRequest)
+		fields []string
+	}{
+		{"valid", func(r *pb.PingRequest) {}, nil},
+		{"missing content", func(r *pb.PingRequest) { r.Content = nil }, []string{"content"}},
+		{"missing id", func(r *pb.PingRequest) { r.Content.Id = "" }, []string{"content.id"}},
+		{"missing data", func(r *pb.PingRequest) { r.Content.Data = nil }, []string{"content.data"}},
+		{"missing id and data", func(r *pb.PingRequest) {
+			r.Content.Id = ""
+			r.Content.Data = nil
+		}, []string{"content.id", "content.data"}},
+		{"data too large", func(r *pb.PingRequest) {
+			r.Content.Data = make([]byte, DefaultLimits.MaxDataSize+1)
+		}, []string{"content.data"}},
+		{"too many metadata entries", func(r *pb.PingRequest) {
+			for i := 0; i <= DefaultLimits.MaxMetadataEntries; i++ {
+				r.Content.Metadata[strings.Repeat("k", i+1)] = "v"
+			}
+		}, []string{"content.metadata"}},
+		{"empty metadata key", func(r *pb.PingRequest) {
+			r.Content.Metadata[""] = "v"
+		}, []string{"content.metadata[]"}},
+		{"metadata key too large", func(r *pb.PingRequest) {
+			r.Content.Metadata[strings.Repeat("k", DefaultLimits.MaxMetadataKeySize+1)] = "v"
+		}, []string{"content.metadata[" + strings.Repeat("k", DefaultLimits.MaxMetadataKeySize+1) + "]"}},
+		{"metadata value too large", func(r *pb.PingRequest) {
+			r.Content.Metadata["key"] = strings.Repeat("v", DefaultLimits.MaxMetadataValueSize+1)
+		}, []string{"content.metadata[key]"}},
+		{"sent in future", func(r *pb.PingRequest) {
+			r.Sent = time.Now().Add(time.Hour).UnixNano()
+		}, []string{"sent"}},
+		{"sent within skew", func(r *pb.PingRequest) {
+			r.Sent = time.Now().Add(time.Second).UnixNano()
+		}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := getTestRequest()
+			tt.modify(req)
+
+			err := validateRequest(req, DefaultLimits)
+			if tt.fields == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.Equal(t, codes.InvalidArgument, status.Code(err))
+			assert.Equal(t, tt.fields, violationFields(t, err))
+		})
+	}
+}
+
+func TestValidationStatus(t *testing.T) {
+	lis := startBufconnServer(t)
+	c := pb.NewServiceClient(dialConn(t, lis))
+	ctx := context.Background()
+
+	invalid := getTestRequest()
+	invalid.Content.Id = ""
+
+	t.Run("ping", func(t *testing.T) {
+		_, err := c.Ping(ctx, invalid)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		assert.Equal(t, []string{"content.id"}, violationFields(t, err))
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		stream, err := c.Stream(ctx)
+		require.NoError(t, err)
+		require.NoError(t, stream.Send(getTestRequest()))
+		_, err = stream.Recv()
+		require.NoError(t, err)
+
+		require.NoError(t, stream.Send(invalid))
+		res, err := stream.Recv()
+		require.NoError(t, err, "invalid message must not tear down the stream")
+		assert.Equal(t, pb.PingResponse_Error, res.Result)
+		assert.Equal(t, "invalid request: content.id is required", res.ErrorMessage)
+
+		require.NoError(t, stream.Send(getTestRequest()))
+		res, err = stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, pb.PingResponse_Success, res.Result)
+
+		require.NoError(t, stream.CloseSend())
+		_, err = stream.Recv()
+		assert.Equal(t, io.EOF, err)
+	})
+}
+
+func TestStreamListResults(t *testing.T) {
+	lis := startBufconnServer(t)
+	c := dialBufconn(t, lis)
+
+	results, err := c.StreamList(context.Background(), []string{"a", "", "b"})
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+	assert.Equal(t, pb.PingResponse_Success, results[0].Result)
+	assert.Equal(t, pb.PingResponse_Error, results[1].Result)
+	assert.Contains(t, results[1].ErrorMessage, "content.data is required")
+	assert.Equal(t, pb.PingResponse_Success, results[2].Result)
+}
+
+func TestValidationGateway(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := NewPingService(lis)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { _ = srv.Start(ctx) }()
+	t.Cleanup(cancel)
+
+	httpAddr := freeAddr(t)
+	go func() { _ = srv.StartHTTP(ctx, httpAddr) }()
+
+	body := []byte(`{"content": {"data": "dGVzdA=="}}`)
+	var resp *http.Response
+	require.Eventually(t, func() bool {
+		resp, err = http.Post("http://"+httpAddr+"/v1/ping", "application/json", bytes.NewReader(body))
+		return err == nil
+	}, 3*time.Second, 20*time.Millisecond)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	var out struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Details []struct {
+			Type            string `json:"@type"`
+			FieldViolations []struct {
+				Field       string `json:"field"`
+				Description string `json:"description"`
+			} `json:"fieldViolations"`
+		} `json:"details"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&out))
+	assert.Equal(t, int(codes.InvalidArgument), out.Code)
+	require.Len(t, out.Details, 1)
+	assert.Equal(t, "type.googleapis.com/google.rpc.BadRequest", out.Details[0].Type)
+	require.Len(t, out.Details[0].FieldViolations, 1)
+	assert.Equal(t, "content.id", out.Details[0].FieldViolations[0].Field)
+}
+
+func violationFields(t *testing.T, err error) []string {
+	t.Helper()
+	list := make([]string, 0)
+	for _, d := range status.Convert(err).Details() {
+		br, ok := d.(*errdetails.BadRequest)
+		require.True(t, ok)
+		for _, v := range br.FieldViolations {
+			list = append(list, v.Field)
+		}
+	}
+	return list
+}
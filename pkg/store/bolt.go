@@ -0,0 +1,237 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	boltFileMode    = 0600
+	boltOpenTimeout = 3 * time.Second
+)
+
+var (
+	statsBucket    = []byte("stats")
+	messagesBucket = []byte("messages")
+	idsBucket      = []byte("ids")
+)
+
+// NewBoltStore opens the bbolt file at the path, creating it if necessary
+func NewBoltStore(path string, historySize int) (*BoltStore, error) {
+	if path == "" {
+		return nil, errors.New("store path required")
+	}
+	if historySize <= 0 {
+		historySize = DefaultHistorySize
+	}
+
+	db, err := bolt.Open(path, boltFileMode, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error opening store: %s", path)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{statsBucket, messagesBucket, idsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return errors.Wrapf(err, "error creating bucket: %s", b)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db, historySize: historySize}, nil
+}
+
+// BoltStore is a Store persisted in an embedded bbolt file. Counters are keyed
+// by client ID and messages by their sequence so they are ordered oldest first,
+// with an index of the latest sequence of each content ID.
+type BoltStore struct {
+	db          *bolt.DB
+	historySize int
+}
+
+// UpdateStats applies the update to the counters of the client
+func (s *BoltStore) UpdateStats(clientID string, update func(*pb.ClientStats)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(statsBucket)
+		cs := &pb.ClientStats{ClientID: clientID}
+		if v := b.Get([]byte(clientID)); v != nil {
+			if err := proto.Unmarshal(v, cs); err != nil {
+				return errors.Wrapf(err, "error decoding stats of client: %s", clientID)
+			}
+		}
+		update(cs)
+
+		v, err := proto.Marshal(cs)
+		if err != nil {
+			return errors.Wrapf(err, "error encoding stats of client: %s", clientID)
+		}
+		return b.Put([]byte(clientID), v)
+	})
+}
+
+// GetStats returns the counters of the client or nil if it has none
+func (s *BoltStore) GetStats(clientID string) (cs *pb.ClientStats, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(statsBucket).Get([]byte(clientID))
+		if v == nil {
+			return nil
+		}
+		cs = &pb.ClientStats{}
+		return proto.Unmarshal(v, cs)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading stats of client: %s", clientID)
+	}
+	return cs, nil
+}
+
+// ListStats returns the counters of all clients ordered by client ID
+func (s *BoltStore) ListStats() ([]*pb.ClientStats, error) {
+	list := make([]*pb.ClientStats, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(statsBucket).ForEach(func(k, v []byte) error {
+			cs := &pb.ClientStats{}
+			if err := proto.Unmarshal(v, cs); err != nil {
+				return errors.Wrapf(err, "error decoding stats of client: %s", k)
+			}
+			list = append(list, cs)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing stats")
+	}
+	return list, nil
+}
+
+// SaveMessage saves the processed message
+func (s *BoltStore) SaveMessage(msg *pb.Message) error {
+	v, err := proto.Marshal(msg)
+	if err != nil {
+		return errors.Wrap(err, "error encoding message")
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(messagesBucket)
+		ids := tx.Bucket(idsBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return errors.Wrap(err, "error creating message sequence")
+		}
+		if err := b.Put(seqKey(seq), v); err != nil {
+			return errors.Wrap(err, "error saving message")
+		}
+		if id := msg.GetContent().GetId(); id != "" {
+			if err := ids.Put([]byte(id), seqKey(seq)); err != nil {
+				return errors.Wrap(err, "error indexing message")
+			}
+		}
+
+		// remove the messages which fell out of the history
+		if seq <= uint64(s.historySize) {
+			return nil
+		}
+		oldest := seqKey(seq - uint64(s.historySize))
+		c := b.Cursor()
+		for k, v := c.First(); k != nil && bytes.Compare(k, oldest) <= 0; k, v = c.First() {
+			m := &pb.Message{}
+			if err := proto.Unmarshal(v, m); err != nil {
+				return errors.Wrap(err, "error decoding message")
+			}
+			// the index is only removed if no newer message has the same ID
+			id := []byte(m.GetContent().GetId())
+			if len(id) > 0 && bytes.Equal(ids.Get(id), k) {
+				if err := ids.Delete(id); err != nil {
+					return errors.Wrap(err, "error removing message index")
+				}
+			}
+			if err := c.Delete(); err != nil {
+				return errors.Wrap(err, "error removing message")
+			}
+		}
+		return nil
+	})
+}
+
+// ListMessages returns the messages in the history selected by the query
+func (s *BoltStore) ListMessages(q *MessageQuery) (*MessagePage, error) {
+	page := &MessagePage{Messages: make([]*pb.Message, 0)}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(messagesBucket).Cursor()
+		k, v := c.Last()
+		if q.Before != 0 {
+			if k, v = c.Seek(seqKey(q.Before)); k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		}
+
+		var last []byte
+		for ; k != nil; k, v = c.Prev() {
+			m := &pb.Message{}
+			if err := proto.Unmarshal(v, m); err != nil {
+				return errors.Wrap(err, "error decoding message")
+			}
+			if !q.matches(m) {
+				continue
+			}
+			if q.Limit > 0 && len(page.Messages) == q.Limit {
+				page.Next = binary.BigEndian.Uint64(last)
+				break
+			}
+			page.Messages = append(page.Messages, m)
+			last = k
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing messages")
+	}
+	return page, nil
+}
+
+// GetMessage returns the most recent message with the content ID
+func (s *BoltStore) GetMessage(id string) (m *pb.Message, err error) {
+	if id == "" {
+		return nil, nil
+	}
+	err = s.db.View(func(tx *bolt.Tx) error {
+		seq := tx.Bucket(idsBucket).Get([]byte(id))
+		if seq == nil {
+			return nil
+		}
+		v := tx.Bucket(messagesBucket).Get(seq)
+		if v == nil {
+			return nil
+		}
+		m = &pb.Message{}
+		return proto.Unmarshal(v, m)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading message: %s", id)
+	}
+	return m, nil
+}
+
+// Close closes the underlying bbolt file
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func seqKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
@@ -0,0 +1,133 @@
+package store
+
+import (
+	"sort"
+	"sync"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// NewMemoryStore creates a store which keeps everything in memory
+func NewMemoryStore(historySize int) *MemoryStore {
+	if historySize <= 0 {
+		historySize = DefaultHistorySize
+	}
+	return &MemoryStore{
+		historySize: historySize,
+		stats:       make(map[string]*pb.ClientStats),
+		messages:    make([]*storedMessage, 0, historySize),
+	}
+}
+
+// MemoryStore is a Store which keeps everything in memory
+type MemoryStore struct {
+	lock        sync.Mutex
+	historySize int
+	stats       map[string]*pb.ClientStats
+	messages    []*storedMessage
+	seq         uint64
+}
+
+// storedMessage is a message with the sequence it was saved under
+type storedMessage struct {
+	seq uint64
+	msg *pb.Message
+}
+
+// UpdateStats applies the update to the counters of the client
+func (s *MemoryStore) UpdateStats(clientID string, update func(*pb.ClientStats)) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	cs, ok := s.stats[clientID]
+	if !ok {
+		cs = &pb.ClientStats{ClientID: clientID}
+		s.stats[clientID] = cs
+	}
+	update(cs)
+	return nil
+}
+
+// GetStats returns the counters of the client or nil if it has none
+func (s *MemoryStore) GetStats(clientID string) (*pb.ClientStats, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	cs, ok := s.stats[clientID]
+	if !ok {
+		return nil, nil
+	}
+	return proto.Clone(cs).(*pb.ClientStats), nil
+}
+
+// ListStats returns the counters of all clients ordered by client ID
+func (s *MemoryStore) ListStats() ([]*pb.ClientStats, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	list := make([]*pb.ClientStats, 0, len(s.stats))
+	for _, cs := range s.stats {
+		list = append(list, proto.Clone(cs).(*pb.ClientStats))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ClientID < list[j].ClientID
+	})
+	return list, nil
+}
+
+// SaveMessage saves the processed message
+func (s *MemoryStore) SaveMessage(msg *pb.Message) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.seq++
+	s.messages = append(s.messages, &storedMessage{seq: s.seq, msg: proto.Clone(msg).(*pb.Message)})
+	if over := len(s.messages) - s.historySize; over > 0 {
+		s.messages = append(s.messages[:0], s.messages[over:]...)
+	}
+	return nil
+}
+
+// ListMessages returns the messages in the history selected by the query
+func (s *MemoryStore) ListMessages(q *MessageQuery) (*MessagePage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	page := &MessagePage{Messages: make([]*pb.Message, 0)}
+	var last uint64
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		m := s.messages[i]
+		if q.Before != 0 && m.seq >= q.Before {
+			continue
+		}
+		if !q.matches(m.msg) {
+			continue
+		}
+		if q.Limit > 0 && len(page.Messages) == q.Limit {
+			page.Next = last
+			break
+		}
+		page.Messages = append(page.Messages, proto.Clone(m.msg).(*pb.Message))
+		last = m.seq
+	}
+	return page, nil
+}
+
+// GetMessage returns the most recent message with the content ID
+func (s *MemoryStore) GetMessage(id string) (*pb.Message, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		if m := s.messages[i].msg; m.GetContent().GetId() == id {
+			return proto.Clone(m).(*pb.Message), nil
+		}
+	}
+	return nil, nil
+}
+
+// Close is a no-op for the in-memory store
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,78 @@
+package store
+
+import (
+	"strings"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// MemoryType selects the in-memory store, its content is lost on restart
+	MemoryType = "memory"
+	// BoltType selects the store persisted in an embedded bbolt file
+	BoltType = "bolt"
+
+	// DefaultHistorySize is the default number of processed messages kept
+	DefaultHistorySize = 100
+)
+
+// Store persists the message counters of each client and the history of the
+// most recently processed messages
+type Store interface {
+	// UpdateStats applies the update to the counters of the client within a
+	// single transaction, creating them if the client has none yet
+	UpdateStats(clientID string, update func(*pb.ClientStats)) error
+	// GetStats returns the counters of the client or nil if it has none
+	GetStats(clientID string) (*pb.ClientStats, error)
+	// ListStats returns the counters of all clients ordered by client ID
+	ListStats() ([]*pb.ClientStats, error)
+	// SaveMessage saves the processed message, removing the oldest ones once
+	// the history size is exceeded
+	SaveMessage(msg *pb.Message) error
+	// ListMessages returns the messages in the history selected by the
+	// query, newest first
+	ListMessages(q *MessageQuery) (*MessagePage, error)
+	// GetMessage returns the most recent message with the content ID or nil
+	// if there is none in the history
+	GetMessage(id string) (*pb.Message, error)
+	// Close releases the resources held by the store
+	Close() error
+}
+
+// MessageQuery selects the messages returned by ListMessages
+type MessageQuery struct {
+	// Before selects only the messages saved before this cursor, when zero
+	// the messages are selected from the newest one
+	Before uint64
+	// Limit is the max number of messages returned, all when zero
+	Limit int
+	// Match selects the messages to return, all when nil
+	Match func(*pb.Message) bool
+}
+
+func (q *MessageQuery) matches(m *pb.Message) bool {
+	return q.Match == nil || q.Match(m)
+}
+
+// MessagePage is a single page of messages returned by ListMessages
+type MessagePage struct {
+	// Messages are the selected messages, newest first
+	Messages []*pb.Message
+	// Next is the cursor to select the following page with, zero when there
+	// are no more messages
+	Next uint64
+}
+
+// New creates a store of the specified type. The path is only used by the
+// types persisted to a file.
+func New(storeType, path string, historySize int) (Store, error) {
+	switch strings.ToLower(storeType) {
+	case MemoryType, "":
+		return NewMemoryStore(historySize), nil
+	case BoltType:
+		return NewBoltStore(path, historySize)
+	default:
+		return nil, errors.Errorf("unsupported store type: %s", storeType)
+	}
+}
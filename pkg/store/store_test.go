@@ -0,0 +1,198 @@
+package store
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	pb "github.com/mchmarny/grpc-lab/pkg/api/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStores(t *testing.T) {
+	stores := map[string]func(t *testing.T, historySize int) Store{
+		MemoryType: func(t *testing.T, historySize int) Store {
+			return NewMemoryStore(historySize)
+		},
+		BoltType: func(t *testing.T, historySize int) Store {
+			s, err := NewBoltStore(filepath.Join(t.TempDir(), "test.db"), historySize)
+			require.NoError(t, err)
+			return s
+		},
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			t.Run("stats", func(t *testing.T) {
+				s := newStore(t, 3)
+				defer s.Close()
+				testStats(t, s)
+			})
+			t.Run("history", func(t *testing.T) {
+				s := newStore(t, 3)
+				defer s.Close()
+				testHistory(t, s)
+			})
+			t.Run("paging", func(t *testing.T) {
+				s := newStore(t, 20)
+				defer s.Close()
+				testPaging(t, s)
+			})
+		})
+	}
+}
+
+func testStats(t *testing.T, s Store) {
+	cs, err := s.GetStats("a")
+	require.NoError(t, err)
+	assert.Nil(t, cs)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			assert.NoError(t, s.UpdateStats(id, func(cs *pb.ClientStats) {
+				cs.MessageCount++
+			}))
+		}([]string{"b", "a"}[i%2])
+	}
+	wg.Wait()
+
+	cs, err = s.GetStats("a")
+	require.NoError(t, err)
+	assert.Equal(t, "a", cs.ClientID)
+	assert.Equal(t, int64(5), cs.MessageCount)
+
+	cs.MessageCount = 100
+	cs, err = s.GetStats("a")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), cs.MessageCount, "returned stats are copies")
+
+	list, err := s.ListStats()
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "a", list[0].ClientID)
+	assert.Equal(t, "b", list[1].ClientID)
+}
+
+func testHistory(t *testing.T, s Store) {
+	page, err := s.ListMessages(&MessageQuery{})
+	require.NoError(t, err)
+	assert.Empty(t, page.Messages)
+	assert.Zero(t, page.Next)
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, s.SaveMessage(testMessage(i)))
+	}
+
+	page, err = s.ListMessages(&MessageQuery{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"id4", "id3", "id2"}, messageIDs(page), "history is trimmed, newest first")
+	assert.Zero(t, page.Next)
+
+	m, err := s.GetMessage("id3")
+	require.NoError(t, err)
+	assert.Equal(t, "id3", m.Content.Id)
+	assert.Equal(t, "test", m.ClientID)
+
+	m, err = s.GetMessage("id0")
+	require.NoError(t, err)
+	assert.Nil(t, m, "trimmed messages are not found")
+}
+
+func testPaging(t *testing.T, s Store) {
+	for i := 0; i < 10; i++ {
+		require.NoError(t, s.SaveMessage(testMessage(i)))
+	}
+
+	even := func(m *pb.Message) bool { return m.Processed%2 == 0 }
+	q := &MessageQuery{Limit: 2, Match: even}
+	ids := make([]string, 0)
+	for pages := 1; ; pages++ {
+		page, err := s.ListMessages(q)
+		require.NoError(t, err)
+		ids = append(ids, messageIDs(page)...)
+		if page.Next == 0 {
+			assert.Equal(t, 3, pages)
+			break
+		}
+		q.Before = page.Next
+	}
+	assert.Equal(t, []string{"id8", "id6", "id4", "id2", "id0"}, ids)
+
+	// a newer message with the same content ID replaces the older one
+	dup := testMessage(3)
+	dup.ClientID = "dup"
+	require.NoError(t, s.SaveMessage(dup))
+	m, err := s.GetMessage("id3")
+	require.NoError(t, err)
+	assert.Equal(t, "dup", m.ClientID)
+}
+
+func TestBoltStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	s, err := NewBoltStore(path, 2)
+	require.NoError(t, err)
+	require.NoError(t, s.UpdateStats("a", func(cs *pb.ClientStats) { cs.MessageCount = 7 }))
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.SaveMessage(testMessage(i)))
+	}
+	require.NoError(t, s.Close())
+
+	s, err = NewBoltStore(path, 2)
+	require.NoError(t, err)
+	defer s.Close()
+
+	cs, err := s.GetStats("a")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), cs.MessageCount)
+
+	require.NoError(t, s.SaveMessage(testMessage(3)))
+	page, err := s.ListMessages(&MessageQuery{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"id3", "id2"}, messageIDs(page))
+
+	m, err := s.GetMessage("id2")
+	require.NoError(t, err)
+	assert.Equal(t, "id2", m.Content.Id)
+}
+
+func TestNew(t *testing.T) {
+	s, err := New("", "", 0)
+	require.NoError(t, err)
+	assert.IsType(t, &MemoryStore{}, s)
+
+	s, err = New("Bolt", filepath.Join(t.TempDir(), "test.db"), 0)
+	require.NoError(t, err)
+	assert.IsType(t, &BoltStore{}, s)
+	assert.NoError(t, s.Close())
+
+	_, err = New(BoltType, "", 0)
+	assert.Error(t, err)
+
+	_, err = New("redis", "", 0)
+	assert.Error(t, err)
+}
+
+func testMessage(i int) *pb.Message {
+	return &pb.Message{
+		Content: &pb.Content{
+			Id:   fmt.Sprintf("id%d", i),
+			Data: []byte("test"),
+		},
+		ClientID:  "test",
+		Method:    "Ping",
+		Processed: int64(i),
+	}
+}
+
+func messageIDs(page *MessagePage) []string {
+	ids := make([]string, 0, len(page.Messages))
+	for _, m := range page.Messages {
+		ids = append(ids, m.Content.Id)
+	}
+	return ids
+}
@@ -0,0 +1,82 @@
+package tracing
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/mchmarny/grpc-lab/pkg/config"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+)
+
+const (
+	// ExporterEnvVar selects the span exporter: otlp, stdout, or none
+	ExporterEnvVar = "OTEL_TRACES_EXPORTER"
+	// EndpointEnvVar is the standard OTLP endpoint env var, when set otlp is the default exporter
+	EndpointEnvVar = "OTEL_EXPORTER_OTLP_ENDPOINT"
+
+	// InstrumentationName identifies the spans created by this module
+	InstrumentationName = "github.com/mchmarny/grpc-lab"
+)
+
+// ShutdownFunc flushes and stops the configured exporter
+type ShutdownFunc func(context.Context) error
+
+// Propagator returns the W3C trace context and baggage propagator used
+// across the gateway, server, and client regardless of the global one
+func Propagator() propagation.TextMapPropagator {
+	return propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+}
+
+// Init configures the global tracer provider and propagator based on the
+// standard OTel env vars. The OTLP exporter reads its own settings
+// (e.g. OTEL_EXPORTER_OTLP_ENDPOINT, OTEL_EXPORTER_OTLP_INSECURE) from env.
+func Init(ctx context.Context, serviceName string) (ShutdownFunc, error) {
+	otel.SetTextMapPropagator(Propagator())
+
+	defaultExporter := "none"
+	if _, ok := os.LookupEnv(EndpointEnvVar); ok {
+		defaultExporter = "otlp"
+	}
+
+	var exp sdktrace.SpanExporter
+	var err error
+	name := strings.ToLower(config.GetEnvVar(ExporterEnvVar, defaultExporter))
+	switch name {
+	case "otlp":
+		exp, err = otlptracegrpc.New(ctx)
+	case "stdout":
+		exp, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "none", "":
+		return func(context.Context) error { return nil }, nil
+	default:
+		return nil, errors.Errorf("unsupported trace exporter: %s", name)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating %s trace exporter", name)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceNameKey.String(serviceName),
+	))
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating trace resource")
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	log.Infof("tracing enabled using %s exporter", name)
+	return tp.Shutdown, nil
+}